@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/micrictor/jpat/internal/admin"
+	"github.com/micrictor/jpat/internal/config"
+)
+
+// adminCmd represents the admin command
+var adminCmd = &cobra.Command{
+	Use:   "admin",
+	Short: "Manage the terms of a running jpat server",
+	Long:  `Lists, extends and revokes the active terms of a jpat server through its admin socket`,
+}
+
+var adminListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the active terms",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		terms, err := adminClient(cmd).List()
+		if err != nil {
+			log.Fatalf("failed to list terms: %v", err)
+		}
+		printTerms(terms)
+	},
+}
+
+var adminRevokeCmd = &cobra.Command{
+	Use:   "revoke",
+	Short: "Revoke the terms matching every given flag",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var request admin.RevokeRequest
+		request.ID, _ = cmd.Flags().GetString("id")
+		request.Source, _ = cmd.Flags().GetString("source")
+		request.Subject, _ = cmd.Flags().GetString("subject")
+		if request == (admin.RevokeRequest{}) {
+			log.Fatalf("one of --id, --source or --subject is required")
+		}
+		terms, err := adminClient(cmd).Revoke(request)
+		if err != nil {
+			log.Fatalf("failed to revoke terms: %v", err)
+		}
+		fmt.Printf("Revoked %d terms\n", len(terms))
+		printTerms(terms)
+	},
+}
+
+var adminExtendCmd = &cobra.Command{
+	Use:   "extend <id>",
+	Short: "Extend a term",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		duration, _ := cmd.Flags().GetDuration("by")
+		term, err := adminClient(cmd).Extend(args[0], duration)
+		if err != nil {
+			log.Fatalf("failed to extend term: %v", err)
+		}
+		printTerms([]admin.TermInfo{term})
+	},
+}
+
+var adminFlushCmd = &cobra.Command{
+	Use:   "flush",
+	Short: "Revoke every active term",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		terms, err := adminClient(cmd).Flush()
+		if err != nil {
+			log.Fatalf("failed to flush terms: %v", err)
+		}
+		fmt.Printf("Revoked %d terms\n", len(terms))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(adminCmd)
+	adminCmd.PersistentFlags().String("socket", config.DEFAULT_ADMIN_SOCKET, "The server's admin socket")
+
+	adminCmd.AddCommand(adminListCmd, adminRevokeCmd, adminExtendCmd, adminFlushCmd)
+	adminRevokeCmd.Flags().String("id", "", "Revoke the term with this ID")
+	adminRevokeCmd.Flags().String("source", "", "Revoke terms permitting this source address")
+	adminRevokeCmd.Flags().String("subject", "", "Revoke terms opened by tokens with this sub claim")
+	adminExtendCmd.Flags().Duration("by", time.Minute*5, "How long to extend the term by")
+}
+
+func adminClient(cmd *cobra.Command) *admin.Client {
+	socket, _ := cmd.Flags().GetString("socket")
+	return admin.NewClient(socket)
+}
+
+func printTerms(terms []admin.TermInfo) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tSUBJECT\tSOURCE\tDESTINATION\tEXPIRES")
+	for _, term := range terms {
+		expires := time.Unix(term.Expiration, 0)
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s %s/%s\t%s (in %s)\n", term.ID, term.Subject, term.Source,
+			term.Destination, term.Protocol, term.Ports, expires.Format(time.RFC3339), time.Until(expires).Round(time.Second))
+	}
+	writer.Flush()
+}
@@ -3,6 +3,10 @@ package cmd
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"net"
@@ -12,8 +16,13 @@ import (
 
 	"github.com/golang-jwt/jwt"
 	"github.com/golang/protobuf/proto"
+	"github.com/micrictor/jpat/internal/envelope"
+	"github.com/micrictor/jpat/internal/freshness"
+	"github.com/micrictor/jpat/internal/signing"
 	pb "github.com/micrictor/jpat/pkg/jpat"
 	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 // clientCmd represents the client command
@@ -30,11 +39,21 @@ func init() {
 	clientCmd.Flags().StringP("server", "s", "", "JPAT server to connect to")
 	clientCmd.Flags().StringP("port", "p", "1337", "UDP port the JPAT server is listening on.")
 	clientCmd.Flags().StringP("token", "t", "", "JWT token to pass")
+	clientCmd.Flags().String("service", "", "Name of the service to open. Defaults to the server's default service.")
+	clientCmd.Flags().String("serverKey", "", "PEM-encoded Ed25519 public key of the server. If set, replies must be signed by it.")
+	clientCmd.Flags().String("envelopeKey", "", "Base64 X25519 envelope key of the server. If set, the request is sealed to it so the token isn't sent in the clear.")
+	clientCmd.Flags().String("freshnessKey", "", "Base64 HMAC key shared with the server. If set, the request is stamped with the time and a nonce.")
+	clientCmd.Flags().Bool("grpc", false, "Send the request to the server's gRPC (TLS) listener instead of over UDP")
+	clientCmd.Flags().String("grpcCa", "", "PEM file of CAs trusted for the gRPC server certificate. Defaults to the system roots.")
+	clientCmd.Flags().BoolP("ipv4", "4", false, "Only connect to the server over IPv4")
+	clientCmd.Flags().BoolP("ipv6", "6", false, "Only connect to the server over IPv6")
 	clientCmd.Flags().Duration("timeout", time.Second*5, "Client connection idle timeout")
 	clientCmd.Flags().Duration("deadline", time.Minute*5, "Connection deadline (0 == unlimited)")
-	clientCmd.Flags().String("jwtAlgo", "hs256", "JWT signature algorithm.")
-	clientCmd.Flags().String("jwtSecret", "secretstring", "JWT signing secret. Behaviour depends on algo.")
+	clientCmd.Flags().String("jwtAlgo", "hs256", "JWT signature algorithm. One of hs256, rs256, ps256, ps384, ps512, es256, es384, es512 or eddsa.")
+	clientCmd.Flags().String("jwtSecret", "secretstring", "JWT signing secret for hs256, or the path to a PEM-encoded private key for other algos.")
 	clientCmd.Flags().Duration("jwtDuration", time.Second*30, "Duration for the network access.")
+	clientCmd.Flags().String("jwtIssuer", "", "iss claim for the generated JWT.")
+	clientCmd.Flags().String("jwtAudience", "", "aud claim for the generated JWT.")
 }
 
 func clientMain(cmd *cobra.Command, args []string) {
@@ -42,12 +61,28 @@ func clientMain(cmd *cobra.Command, args []string) {
 	serverPort, _ := cmd.Flags().GetString("port")
 	timeout, _ := cmd.Flags().GetDuration("timeout")
 	deadline, _ := cmd.Flags().GetDuration("deadline")
+	ipv4Only, _ := cmd.Flags().GetBool("ipv4")
+	ipv6Only, _ := cmd.Flags().GetBool("ipv6")
+	network := "udp"
+	switch {
+	case ipv4Only && ipv6Only:
+		log.Fatalf("only one of --ipv4 and --ipv6 may be set")
+	case ipv4Only:
+		network = "udp4"
+	case ipv6Only:
+		network = "udp6"
+	}
 	tokenDialer := &net.Dialer{
 		Timeout: timeout,
 	}
-	request, err := proto.Marshal(&pb.AuthRequest{
-		Token: getOrCreateToken(cmd),
-	})
+	service, _ := cmd.Flags().GetString("service")
+	authRequest := &pb.AuthRequest{
+		Token:   getOrCreateToken(cmd),
+		Service: service,
+	}
+	stampRequest(cmd, authRequest)
+	sealed := sealRequest(cmd, authRequest)
+	request, err := proto.Marshal(sealed)
 	if err != nil {
 		log.Fatalf("%v", err) // this should never happen
 	}
@@ -56,8 +91,16 @@ func clientMain(cmd *cobra.Command, args []string) {
 	parentContext, cancelFunc := context.WithDeadline(parentContext, time.Now().Add(deadline))
 	defer cancelFunc()
 
-	log.Printf("attempting to connect to udp://%s:%s", server, serverPort)
-	conn, err := tokenDialer.DialContext(parentContext, "udp", server+":"+serverPort)
+	serverAddr := net.JoinHostPort(server, serverPort)
+	if useGrpc, _ := cmd.Flags().GetBool("grpc"); useGrpc {
+		caFile, _ := cmd.Flags().GetString("grpcCa")
+		reply := grpcRequest(parentContext, tokenDialer, strings.Replace(network, "udp", "tcp", 1), serverAddr, caFile, sealed)
+		verifyReply(cmd, authRequest.Token, reply)
+		printReply(reply)
+		return
+	}
+	log.Printf("attempting to connect to udp://%s", serverAddr)
+	conn, err := tokenDialer.DialContext(parentContext, network, serverAddr)
 
 	if err != nil {
 		log.Fatalf("dial: %v", err)
@@ -77,9 +120,101 @@ func clientMain(cmd *cobra.Command, args []string) {
 	conn.Write(request)
 
 	reply := <-replyChannel
+	verifyReply(cmd, authRequest.Token, &reply)
+	printReply(&reply)
+}
+
+// Stamp the request with the time and a nonce, if there is a freshness key
+func stampRequest(cmd *cobra.Command, request *pb.AuthRequest) {
+	keyFile, _ := cmd.Flags().GetString("freshnessKey")
+	if keyFile == "" {
+		return
+	}
+	key, err := freshness.LoadKey(keyFile)
+	if err != nil {
+		log.Fatalf("failed to load freshness key: %v", err)
+	}
+	if err := freshness.Stamp(key, request, time.Now()); err != nil {
+		log.Fatalf("failed to stamp request: %v", err)
+	}
+}
+
+// Seal the request to the server's envelope key, if there is one
+func sealRequest(cmd *cobra.Command, request *pb.AuthRequest) *pb.AuthRequest {
+	keyFile, _ := cmd.Flags().GetString("envelopeKey")
+	if keyFile == "" {
+		return request
+	}
+	key, err := envelope.LoadPublicKey(keyFile)
+	if err != nil {
+		log.Fatalf("failed to load envelope key: %v", err)
+	}
+	sealed, err := envelope.Seal(key, request)
+	if err != nil {
+		log.Fatalf("failed to seal request: %v", err)
+	}
+	return sealed
+}
+
+// Check the reply against the pinned server key, if there is one
+func verifyReply(cmd *cobra.Command, token string, reply *pb.AuthReply) {
+	keyFile, _ := cmd.Flags().GetString("serverKey")
+	if keyFile == "" {
+		return
+	}
+	key, err := signing.LoadPublicKey(keyFile)
+	if err != nil {
+		log.Fatalf("failed to load server key: %v", err)
+	}
+	if err := signing.VerifyReply(key, token, reply); err != nil {
+		log.Fatalf("untrusted reply: %v", err)
+	}
+}
+
+// Print the reply, exiting non-zero if the request was rejected
+func printReply(reply *pb.AuthReply) {
+	if reply.Status != pb.Status_OK {
+		if reply.Message != "" {
+			log.Fatalf("request rejected (%s): %s", reply.Status, reply.Message)
+		}
+		log.Fatalf("request rejected (%s)", reply.Status)
+	}
 	fmt.Printf("reply: %v\n", reply)
 }
 
+// Send the request to the gRPC listener, failing with the status the server returned
+func grpcRequest(ctx context.Context, dialer *net.Dialer, network string, serverAddr string, caFile string, request *pb.AuthRequest) *pb.AuthReply {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pemData, err := os.ReadFile(caFile)
+		if err != nil {
+			log.Fatalf("failed to read %s: %v", caFile, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pemData) {
+			log.Fatalf("no certificates found in %s", caFile)
+		}
+	}
+
+	log.Printf("attempting to connect to grpc://%s", serverAddr)
+	conn, err := grpc.DialContext(ctx, serverAddr,
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		}),
+	)
+	if err != nil {
+		log.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	reply, err := pb.NewJpatClient(conn).RequestAuthorization(ctx, request)
+	if err != nil {
+		log.Fatalf("request failed: %v", err)
+	}
+	return reply
+}
+
 func clientListener(conn net.PacketConn, replyChannel chan (pb.AuthReply)) {
 	buffer := make([]byte, 1024*8) // Max JWT size is 8KB
 	n, _, err := conn.ReadFrom(buffer)
@@ -111,11 +246,24 @@ func getOrCreateToken(cmd *cobra.Command) string {
 		return ""
 	}
 
-	exp := time.Now().Add(duration).Unix()
+	now := time.Now()
+	exp := now.Add(duration).Unix()
 
 	var claims jwt.MapClaims = make(map[string]interface{})
 	claims["exp"] = exp
+	claims["iat"] = now.Unix()
+	claims["jti"] = newJti()
+	if issuer, _ := cmd.Flags().GetString("jwtIssuer"); issuer != "" {
+		claims["iss"] = issuer
+	}
+	if audience, _ := cmd.Flags().GetString("jwtAudience"); audience != "" {
+		claims["aud"] = audience
+	}
 
+	// EdDSA is the only algorithm name that isn't all uppercase
+	if inputAlg == "EDDSA" {
+		inputAlg = jwt.SigningMethodEdDSA.Alg()
+	}
 	alg := jwt.GetSigningMethod(inputAlg)
 	if alg == nil {
 		log.Fatalf("Couldn't find signing method: %v", inputAlg)
@@ -124,22 +272,18 @@ func getOrCreateToken(cmd *cobra.Command) string {
 	token := jwt.NewWithClaims(alg, claims)
 
 	var key interface{}
-	switch inputAlg {
-	case "HS256":
+	switch alg.(type) {
+	case *jwt.SigningMethodHMAC:
 		key = []byte(secret)
-	case "RS256":
-		fileHandle, err := os.Open(secret)
-		if err != nil {
-			log.Fatalf("Couldn't open rsa secret %v", err)
-		}
-
-		buf := new(bytes.Buffer)
-		buf.ReadFrom(fileHandle)
-
-		key, err = jwt.ParseRSAPrivateKeyFromPEM(buf.Bytes())
-		if err != nil {
-			log.Fatalf("Couldn't convert key data to key; Is it PEM-encoded? %v", err)
-		}
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		key, err = jwt.ParseRSAPrivateKeyFromPEM(readKeyFile(secret))
+	case *jwt.SigningMethodECDSA:
+		key, err = jwt.ParseECPrivateKeyFromPEM(readKeyFile(secret))
+	case *jwt.SigningMethodEd25519:
+		key, err = jwt.ParseEdPrivateKeyFromPEM(readKeyFile(secret))
+	}
+	if err != nil {
+		log.Fatalf("Couldn't convert key data to key; Is it PEM-encoded? %v", err)
 	}
 
 	out, err := token.SignedString(key)
@@ -149,3 +293,24 @@ func getOrCreateToken(cmd *cobra.Command) string {
 
 	return out
 }
+
+func readKeyFile(path string) []byte {
+	fileHandle, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Couldn't open private key %v", err)
+	}
+	defer fileHandle.Close()
+
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(fileHandle)
+	return buf.Bytes()
+}
+
+// Generate a random token ID, so servers with replay protection accept the token once.
+func newJti() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		log.Fatalf("Couldn't generate jti: %v", err)
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/micrictor/jpat/internal/config"
+)
+
+// Editors often write a file in several steps, so reload once it has been quiet this long
+const CONFIG_SETTLE_TIME = 500 * time.Millisecond
+
+// Reload the config on SIGHUP and, if watch is set, whenever the file changes.
+// started is the config the listeners were started with. Designed to run as a
+// goroutine.
+func reloadLoop(configFile string, started *config.AppConfig, watch bool) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	var changes chan fsnotify.Event
+	var watchErrors chan error
+	if watch {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			log.Fatalf("Failed to watch config file: %v", err)
+		}
+		defer watcher.Close()
+		// Watch the directory, as editors may replace the file rather than write to it
+		if err := watcher.Add(filepath.Dir(configFile)); err != nil {
+			log.Fatalf("Failed to watch config file: %v", err)
+		}
+		changes, watchErrors = watcher.Events, watcher.Errors
+	}
+
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-hangup:
+			reloadConfig(configFile, started)
+		case event := <-changes:
+			if filepath.Clean(event.Name) == filepath.Clean(configFile) && event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+				settled = time.After(CONFIG_SETTLE_TIME)
+			}
+		case err := <-watchErrors:
+			log.Printf("error watching config file: %v", err)
+		case <-settled:
+			settled = nil
+			reloadConfig(configFile, started)
+		}
+	}
+}
+
+// Parse the config file and swap in a pipeline using it. If the config or any key
+// it names is invalid, the running config is kept. Terms already granted are
+// left alone.
+func reloadConfig(configFile string, started *config.AppConfig) {
+	file, err := os.Open(configFile)
+	if err != nil {
+		log.Printf("Failed to reload config, keeping the running config: %v", err)
+		return
+	}
+	defer file.Close()
+
+	current := authorizer.Load()
+	_, err = config.Reload(file, func(appConfig *config.AppConfig) error {
+		sections := started.RestartRequired(appConfig)
+		for _, section := range sections {
+			// The firewall is only set up for the services it started with
+			if section == "services" {
+				appConfig.Services = started.StartedServices(appConfig)
+			}
+		}
+		next, err := current.Reload(appConfig)
+		if err != nil {
+			return err
+		}
+		if len(sections) > 0 {
+			log.Printf("Changes to %s take effect after a restart", strings.Join(sections, ", "))
+		}
+		authorizer.Store(next)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to reload config, keeping the running config: %v", err)
+		return
+	}
+	log.Printf("Reloaded config from %s", configFile)
+}
@@ -4,16 +4,23 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
-	"strings"
+	"strconv"
+	"sync/atomic"
+	"syscall"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/spf13/cobra"
 
+	"github.com/micrictor/jpat/internal/admin"
+	"github.com/micrictor/jpat/internal/audit"
 	"github.com/micrictor/jpat/internal/config"
+	"github.com/micrictor/jpat/internal/metrics"
+	"github.com/micrictor/jpat/internal/pipeline"
+	"github.com/micrictor/jpat/internal/replay"
 	"github.com/micrictor/jpat/internal/rules"
-	"github.com/micrictor/jpat/internal/token"
 	pb "github.com/micrictor/jpat/pkg/jpat"
 )
 
@@ -29,15 +36,30 @@ var serverCmd = &cobra.Command{
 
 var engine *rules.RulesEngine
 
+// Verifies requests from every listener. Swapped when the config is reloaded.
+var authorizer *pipeline.Current
+
 const DIAL_TIMEOUT = 5 * 1000000000 // 5 second timeout
 
+// Max JWT size is 8KB
+const MAX_PACKET_SIZE = 1024 * 8
+
+// A datagram waiting for a worker
+type packet struct {
+	addr *net.UDPAddr
+	data []byte
+}
+
+// Packets dropped because the queue was full
+var droppedPackets uint64
+
 func init() {
 	rootCmd.AddCommand(serverCmd)
-	engine = rules.New()
 
-	serverCmd.PersistentFlags().IPP("listenAddr", "a", net.IPv4zero, "The address to listen on.")
+	serverCmd.PersistentFlags().IPP("listenAddr", "a", net.IPv6unspecified, "The address to listen on. The default listens on both IPv4 and IPv6.")
 	serverCmd.PersistentFlags().IntP("listenPort", "p", 1337, "The UDP port to listen on.")
 	serverCmd.PersistentFlags().StringP("configFile", "c", "./jpat.yml", "The JPAT config file")
+	serverCmd.PersistentFlags().Bool("watchConfig", false, "Reload the config file when it changes, as well as on SIGHUP")
 }
 
 func serverMain(cmd *cobra.Command) {
@@ -52,8 +74,55 @@ func serverMain(cmd *cobra.Command) {
 	}
 	appConfig := config.New(file)
 	log.Printf("Using config %v", appConfig)
+	auditLog, err := audit.New(appConfig.Audit.Sinks)
+	if err != nil {
+		log.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer auditLog.Close()
+	backend, err := rules.NewBackend(appConfig)
+	if err != nil {
+		log.Fatalf("Failed to create firewall backend: %v", err)
+	}
+	if len(appConfig.Audit.Sinks) > 0 {
+		backend = rules.NewAuditedBackend(backend, auditLog)
+	}
+	engine, err = rules.New(backend, appConfig.Firewall)
+	if err != nil {
+		log.Fatalf("Failed to start rules engine: %v", err)
+	}
+	var replayGuard *replay.Cache
+	if appConfig.Replay.Enabled {
+		replayGuard = replay.New(appConfig.Replay.MaxEntries, appConfig.Replay.AllowSameSource)
+	}
+	initial := pipeline.New(appConfig, engine, replayGuard)
+	if len(appConfig.Audit.Sinks) > 0 {
+		initial.Audit = auditLog
+	}
+	if err := initial.LoadKeys(); err != nil {
+		log.Fatalf("Failed to start: %v", err)
+	}
+	authorizer = pipeline.NewCurrent(initial)
+	watch, _ := cmd.PersistentFlags().GetBool("watchConfig")
+	go reloadLoop(configFile, appConfig, watch)
 
-	s, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", listenAddr, listenPort))
+	if appConfig.Grpc.Listen != "" {
+		go serveGrpc(appConfig.Grpc)
+	}
+	if appConfig.Admin.Socket != "" {
+		go serveAdmin(appConfig.Admin.Socket)
+	}
+	if appConfig.Metrics.Listen != "" {
+		metrics.WatchTerms(func() (int, int64) {
+			terms := engine.ActiveTerms()
+			if len(terms) == 0 {
+				return 0, 0
+			}
+			return len(terms), terms[0].Expiration
+		})
+		go serveMetrics(appConfig.Metrics.Listen)
+	}
+
+	s, err := net.ResolveUDPAddr("udp", net.JoinHostPort(listenAddr.String(), strconv.Itoa(listenPort)))
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -67,57 +136,88 @@ func serverMain(cmd *cobra.Command) {
 
 	defer conn.Close()
 	defer engine.Close()
-	interruptChannel := make(chan os.Signal)
-	signal.Notify(interruptChannel, os.Interrupt)
+	interruptChannel := make(chan os.Signal, 1)
+	// SIGTERM is what systemd and docker stop send
+	signal.Notify(interruptChannel, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-interruptChannel
 		engine.Close()
+		// Closed after the engine, which audits the terms it deletes
+		auditLog.Close()
 		os.Exit(1)
 	}()
 
+	queue := make(chan packet, appConfig.Udp.QueueSize)
+	for i := 0; i < appConfig.Udp.Workers; i++ {
+		go worker(queue)
+	}
+
+	buffer := make([]byte, MAX_PACKET_SIZE)
 	for {
-		buffer := make([]byte, 1024*8) // Max JWT size is 8KB
 		n, addr, err := conn.ReadFromUDP(buffer)
 		if err != nil {
 			log.Println(err)
+			continue
+		}
+
+		metrics.PacketsReceived.Inc()
+		// Copy the packet out, so the buffer can be reused for the next one
+		data := make([]byte, n)
+		copy(data, buffer[:n])
+		select {
+		case queue <- packet{addr: addr, data: data}:
+		default:
+			metrics.PacketsDropped.Inc()
+			if dropped := atomic.AddUint64(&droppedPackets, 1); dropped%1000 == 1 {
+				log.Printf("Request queue is full, %d packets dropped so far", dropped)
+			}
 		}
-		log.Printf("Recieved request from %s", addr.String())
+	}
+}
 
-		go processPacket(addr, buffer[:n], appConfig)
+// Process packets from the queue. Designed to run as a goroutine.
+func worker(queue chan packet) {
+	for p := range queue {
+		processPacket(p.addr, p.data)
 	}
 }
 
-func processPacket(addr *net.UDPAddr, buffer []byte, appConfig *config.AppConfig) {
+func processPacket(addr *net.UDPAddr, buffer []byte) {
+	p := authorizer.Load()
+	// Sources over their limit get no reply, so a flood costs as little as possible
+	if err := p.Admit(addr.IP); err != nil {
+		pipeline.Reject(err)
+		return
+	}
+	log.Printf("Recieved request from %s", addr.String())
+
 	var authRequest pb.AuthRequest
 	err := proto.Unmarshal(buffer, &authRequest)
 	if err != nil {
 		log.Printf("Error unmarshaling input: %s", err.Error())
+		metrics.ParseFailures.Inc()
 		return
 	}
 
-	inputToken, err := token.ProcessToken(authRequest.Token, appConfig)
-	if err != nil {
-		log.Printf("token processing failed: %v", err)
-		return
+	request, err := p.Open(&authRequest)
+	var reply *pb.AuthReply
+	if err == nil {
+		reply, err = p.Authorize(addr.IP, request)
 	}
-
-	expiration, err := engine.TryAddTerm(addr, inputToken, appConfig)
+	p.Record(pipeline.TRANSPORT_UDP, addr.IP, request, reply, err)
 	if err != nil {
-		log.Printf("failed to validate token: %v", err)
-		return
+		log.Printf("rejecting request from %s: %v", addr.String(), err)
+		errorReplies := p.Config.ErrorReplies
+		if errorReplies.Silent {
+			return
+		}
+		reply = pipeline.ErrorReply(err, errorReplies.HideDetails)
 	}
+	p.Sign(request, reply)
 
 	// Send the reply back before applying firewall policies
-	var sb strings.Builder
-	sb.WriteString(appConfig.Service.Host)
-	sb.WriteRune(':')
-	sb.WriteString(fmt.Sprintf("%d", appConfig.Service.Port))
-	reply := pb.AuthReply{
-		Socket:     sb.String(),
-		Expiration: expiration,
-	}
 	replyChan := make(chan (error))
-	go sendReply(reply, addr, replyChan)
+	go sendReply(*reply, addr, replyChan)
 
 	replyErr := <-replyChan
 	if replyErr != nil {
@@ -130,11 +230,14 @@ func sendReply(reply pb.AuthReply, addr *net.UDPAddr, doneChan chan (error)) {
 	conn, err := net.DialTimeout("udp", addr.String(), DIAL_TIMEOUT)
 	if err != nil {
 		doneChan <- err
+		return
 	}
 
 	serializedReply, err := proto.Marshal(&reply)
 	if err != nil {
+		conn.Close()
 		doneChan <- err
+		return
 	}
 	n, err := conn.Write(serializedReply)
 	log.Printf("%d bytes written", n)
@@ -142,3 +245,39 @@ func sendReply(reply pb.AuthReply, addr *net.UDPAddr, doneChan chan (error)) {
 	doneChan <- err
 	log.Printf("Replied to %s with %s", addr.String(), reply.String())
 }
+
+// Serve the admin API. Designed to run as a goroutine.
+func serveAdmin(socket string) {
+	listener, err := admin.Listen(socket)
+	if err != nil {
+		log.Fatalf("Failed to listen for admin requests: %v", err)
+	}
+	log.Printf("Serving admin API on %s", socket)
+	if err := http.Serve(listener, admin.NewHandler(engine)); err != nil {
+		log.Fatalf("admin server failed: %v", err)
+	}
+}
+
+// Serve the metrics listener. Designed to run as a goroutine.
+func serveMetrics(listen string) {
+	log.Printf("Serving metrics on %s", listen)
+	if err := metrics.Serve(listen); err != nil {
+		log.Fatalf("metrics server failed: %v", err)
+	}
+}
+
+// Serve the gRPC listener. Designed to run as a goroutine.
+func serveGrpc(grpcConfig config.GrpcConfig) {
+	server, err := pipeline.NewGrpcServer(authorizer, grpcConfig)
+	if err != nil {
+		log.Fatalf("Failed to create grpc server: %v", err)
+	}
+	listener, err := net.Listen("tcp", grpcConfig.Listen)
+	if err != nil {
+		log.Fatalf("Failed to listen for grpc: %v", err)
+	}
+	log.Printf("Serving grpc on %s", listener.Addr().String())
+	if err := server.Serve(listener); err != nil {
+		log.Fatalf("grpc server failed: %v", err)
+	}
+}
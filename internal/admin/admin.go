@@ -0,0 +1,180 @@
+// Package admin serves the local admin API, which lets operators list, extend and
+// revoke active terms. It is served as JSON over HTTP on a Unix socket, so access
+// is controlled by the socket's file permissions.
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/micrictor/jpat/internal/rules"
+)
+
+// Longest a single request can extend a term by, so the new expiration can't overflow
+const MAX_EXTEND_SECONDS = 7 * 24 * 60 * 60
+
+// TermInfo describes an active term
+type TermInfo struct {
+	ID          string `json:"id"`
+	Subject     string `json:"subject,omitempty"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Ports       string `json:"ports"`
+	Protocol    string `json:"protocol"`
+	Expiration  int64  `json:"expiration"`
+}
+
+// RevokeRequest selects the terms to revoke. Every field that is set must match.
+type RevokeRequest struct {
+	ID      string `json:"id,omitempty"`
+	Source  string `json:"source,omitempty"`
+	Subject string `json:"subject,omitempty"`
+}
+
+// ExtendRequest extends the term with the ID by Seconds
+type ExtendRequest struct {
+	ID      string `json:"id"`
+	Seconds int64  `json:"seconds"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func termInfo(term rules.Term) TermInfo {
+	ports := make([]string, len(term.DestinationPorts))
+	for i, port := range term.DestinationPorts {
+		ports[i] = port.String()
+	}
+	return TermInfo{
+		ID:          term.ID,
+		Subject:     term.Subject,
+		Source:      term.Source().String(),
+		Destination: term.DestinationAddr.String(),
+		Ports:       strings.Join(ports, ","),
+		Protocol:    term.Protocol,
+		Expiration:  term.Expiration,
+	}
+}
+
+func termInfos(terms []rules.Term) []TermInfo {
+	infos := make([]TermInfo, len(terms))
+	for i, term := range terms {
+		infos[i] = termInfo(term)
+	}
+	return infos
+}
+
+// NewHandler serves the admin API for the engine
+func NewHandler(engine *rules.RulesEngine) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/terms", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("use GET"))
+			return
+		}
+		writeJSON(w, termInfos(engine.ActiveTerms()))
+	})
+	mux.HandleFunc("/terms/revoke", post(func(w http.ResponseWriter, r *http.Request) {
+		var request RevokeRequest
+		if !readJSON(w, r, &request) {
+			return
+		}
+		if request == (RevokeRequest{}) {
+			writeError(w, http.StatusBadRequest, errors.New("one of id, source or subject is required"))
+			return
+		}
+		filter := rules.TermFilter{ID: request.ID, Subject: request.Subject}
+		if request.Source != "" {
+			if filter.Source = net.ParseIP(request.Source); filter.Source == nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("source %q is not an IP address", request.Source))
+				return
+			}
+		}
+		revoke(w, engine, filter)
+	}))
+	mux.HandleFunc("/terms/flush", post(func(w http.ResponseWriter, r *http.Request) {
+		revoke(w, engine, rules.TermFilter{All: true})
+	}))
+	mux.HandleFunc("/terms/extend", post(func(w http.ResponseWriter, r *http.Request) {
+		var request ExtendRequest
+		if !readJSON(w, r, &request) {
+			return
+		}
+		if request.Seconds <= 0 || request.Seconds > MAX_EXTEND_SECONDS {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("seconds must be between 1 and %d", MAX_EXTEND_SECONDS))
+			return
+		}
+		term, err := engine.Extend(request.ID, time.Duration(request.Seconds)*time.Second)
+		if errors.Is(err, rules.ErrNoSuchTerm) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, termInfo(term))
+	}))
+	return mux
+}
+
+func revoke(w http.ResponseWriter, engine *rules.RulesEngine, filter rules.TermFilter) {
+	revoked, err := engine.Revoke(filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, termInfos(revoked))
+}
+
+func post(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, value interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(value); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %v", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(errorResponse{Error: err.Error()})
+}
+
+// Listen on the Unix socket at path, replacing a socket left by a previous run.
+// Only the server's user can connect.
+func Listen(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := listenUnix(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
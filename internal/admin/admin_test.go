@@ -0,0 +1,181 @@
+package admin
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/micrictor/jpat/internal/config"
+	"github.com/micrictor/jpat/internal/rules"
+)
+
+var testService = config.ServiceConfig{
+	Name:     config.DEFAULT_SERVICE,
+	Host:     "127.0.0.1",
+	Port:     1337,
+	Protocol: "tcp",
+	Ttl:      60,
+}
+
+var testConfig = &config.AppConfig{
+	Services: map[string]config.ServiceConfig{config.DEFAULT_SERVICE: testService},
+	Verification: config.VerificationConfig{
+		SourceClaim: config.DEFAULT_SOURCE_CLAIM,
+	},
+}
+
+// Serve the admin API for a new engine on a socket in a temporary directory
+func newTestServer(t *testing.T) (*rules.RulesEngine, *Client) {
+	engine, err := rules.New(rules.NewMemoryBackend(), config.FirewallConfig{})
+	if err != nil {
+		t.Fatalf("failed to create engine: %v", err)
+	}
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	listener, err := Listen(socket)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go http.Serve(listener, NewHandler(engine))
+	t.Cleanup(func() {
+		listener.Close()
+		engine.Close()
+	})
+	return engine, NewClient(socket)
+}
+
+// Add a term for the subject and source, waiting for it to be applied
+func addTerm(t *testing.T, engine *rules.RulesEngine, subject string, source string) {
+	claims := jwt.MapClaims{"sub": subject, "exp": float64(time.Now().Unix() + 3600)}
+	token := &jwt.Token{Claims: claims, Valid: true}
+	count := len(engine.ActiveTerms())
+	term, err := engine.NewTerm(net.ParseIP(source), token, testService, testConfig)
+	if err != nil {
+		t.Fatalf("failed to add term: %v", err)
+	}
+	engine.ApplyTerm(term)
+	deadline := time.Now().Add(time.Second)
+	for len(engine.ActiveTerms()) == count {
+		if time.Now().After(deadline) {
+			t.Fatalf("term for %s was not applied", subject)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func subjects(terms []TermInfo) string {
+	names := make([]string, len(terms))
+	for i, term := range terms {
+		names[i] = term.Subject
+	}
+	return strings.Join(names, ",")
+}
+
+func TestListen(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	// A socket left behind by a previous run is replaced
+	if err := os.WriteFile(socket, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := Listen(socket)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	if info, _ := os.Stat(socket); info.Mode().Perm() != 0600 {
+		t.Errorf("socket has mode %v, expected 0600", info.Mode().Perm())
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	engine, client := newTestServer(t)
+	addTerm(t, engine, "alice", "192.0.2.1")
+	addTerm(t, engine, "bob", "192.0.2.2")
+	addTerm(t, engine, "carol", "192.0.2.3")
+
+	terms, err := client.List()
+	if err != nil {
+		t.Fatalf("failed to list terms: %v", err)
+	}
+	if len(terms) != 3 {
+		t.Fatalf("expected 3 terms, got %v", terms)
+	}
+	for _, term := range terms {
+		if term.ID == "" || term.Destination != "127.0.0.1" || term.Ports != "1337" || term.Protocol != "tcp" {
+			t.Errorf("unexpected term %+v", term)
+		}
+	}
+
+	revoked, err := client.Revoke(RevokeRequest{Subject: "alice"})
+	if err != nil || subjects(revoked) != "alice" {
+		t.Errorf("revoke by subject revoked %v, %v", revoked, err)
+	}
+	revoked, err = client.Revoke(RevokeRequest{Source: "192.0.2.2"})
+	if err != nil || subjects(revoked) != "bob" {
+		t.Errorf("revoke by source revoked %v, %v", revoked, err)
+	}
+
+	carol := engine.ActiveTerms()[0]
+	extended, err := client.Extend(carol.ID, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to extend term: %v", err)
+	}
+	if extended.ID != carol.ID || extended.Expiration != carol.Expiration+60 {
+		t.Errorf("unexpected extended term %+v", extended)
+	}
+	if _, err := client.Extend("missing", time.Minute); err == nil || !strings.Contains(err.Error(), rules.ErrNoSuchTerm.Error()) {
+		t.Errorf("expected ErrNoSuchTerm, got %v", err)
+	}
+
+	revoked, err = client.Revoke(RevokeRequest{ID: carol.ID})
+	if err != nil || subjects(revoked) != "carol" {
+		t.Errorf("revoke by ID revoked %v, %v", revoked, err)
+	}
+	if terms, _ := client.List(); len(terms) != 0 {
+		t.Errorf("terms still active: %v", terms)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	engine, client := newTestServer(t)
+	addTerm(t, engine, "alice", "192.0.2.1")
+	addTerm(t, engine, "bob", "192.0.2.2")
+
+	revoked, err := client.Flush()
+	if err != nil || len(revoked) != 2 {
+		t.Errorf("flush revoked %v, %v", revoked, err)
+	}
+	if active := engine.ActiveTerms(); len(active) != 0 {
+		t.Errorf("terms still active: %v", active)
+	}
+}
+
+func TestBadRequests(t *testing.T) {
+	engine, client := newTestServer(t)
+	addTerm(t, engine, "alice", "192.0.2.1")
+	term := engine.ActiveTerms()[0]
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{"empty revoke", func() error { _, err := client.Revoke(RevokeRequest{}); return err }},
+		{"invalid source", func() error { _, err := client.Revoke(RevokeRequest{Source: "host"}); return err }},
+		{"negative extension", func() error { _, err := client.Extend(term.ID, -time.Minute); return err }},
+		{"extension over the cap", func() error {
+			_, err := client.Extend(term.ID, (MAX_EXTEND_SECONDS+1)*time.Second)
+			return err
+		}},
+	}
+	for _, tc := range tests {
+		if err := tc.call(); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+	if active := engine.ActiveTerms(); active[0].Expiration != term.Expiration {
+		t.Errorf("rejected extension changed the expiration to %d", active[0].Expiration)
+	}
+}
@@ -0,0 +1,86 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Client calls the admin API on a Unix socket
+type Client struct {
+	http *http.Client
+}
+
+func NewClient(socket string) *Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	return &Client{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+// List the active terms, ordered by expiration
+func (c *Client) List() ([]TermInfo, error) {
+	var terms []TermInfo
+	err := c.call(http.MethodGet, "/terms", nil, &terms)
+	return terms, err
+}
+
+// Revoke the terms matching the request, returning the terms revoked
+func (c *Client) Revoke(request RevokeRequest) ([]TermInfo, error) {
+	var terms []TermInfo
+	err := c.call(http.MethodPost, "/terms/revoke", request, &terms)
+	return terms, err
+}
+
+// Extend the term with the ID by duration, returning the extended term
+func (c *Client) Extend(id string, duration time.Duration) (TermInfo, error) {
+	var term TermInfo
+	err := c.call(http.MethodPost, "/terms/extend", ExtendRequest{ID: id, Seconds: int64(duration.Seconds())}, &term)
+	return term, err
+}
+
+// Flush every active term, returning the terms revoked
+func (c *Client) Flush() ([]TermInfo, error) {
+	var terms []TermInfo
+	err := c.call(http.MethodPost, "/terms/flush", struct{}{}, &terms)
+	return terms, err
+}
+
+func (c *Client) call(method string, path string, request interface{}, reply interface{}) error {
+	var body bytes.Buffer
+	if request != nil {
+		if err := json.NewEncoder(&body).Encode(request); err != nil {
+			return err
+		}
+	}
+	httpRequest, err := http.NewRequest(method, "http://jpat"+path, &body)
+	if err != nil {
+		return err
+	}
+	response, err := c.http.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		var failure errorResponse
+		if err := json.NewDecoder(response.Body).Decode(&failure); err != nil || failure.Error == "" {
+			return fmt.Errorf("admin API returned %s", response.Status)
+		}
+		return errors.New(failure.Error)
+	}
+	return json.NewDecoder(response.Body).Decode(reply)
+}
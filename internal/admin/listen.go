@@ -0,0 +1,16 @@
+//go:build !windows
+
+package admin
+
+import (
+	"net"
+	"syscall"
+)
+
+// Create the socket under a umask that denies everyone else, so there is no
+// window before Listen's chmod in which another user could connect
+func listenUnix(path string) (net.Listener, error) {
+	previous := syscall.Umask(0177)
+	defer syscall.Umask(previous)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,130 @@
+// Package audit writes a machine-readable trail of every authorization decision
+// and firewall change, one JSON record per line.
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/micrictor/jpat/internal/config"
+)
+
+const EVENT_DECISION = "decision"
+const EVENT_TERM_APPLIED = "term_applied"
+const EVENT_TERM_DELETED = "term_deleted"
+
+const DECISION_AUTHORIZED = "authorized"
+const DECISION_REJECTED = "rejected"
+
+// Record is a single audit event. Fields that don't apply to the event are omitted.
+type Record struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Transport string    `json:"transport,omitempty"`
+	Source    string    `json:"source,omitempty"`
+	// Claims of the presented token. For rejected requests they may not be verified.
+	Subject     string `json:"sub,omitempty"`
+	Issuer      string `json:"iss,omitempty"`
+	Jti         string `json:"jti,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Decision    string `json:"decision,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+	Detail      string `json:"detail,omitempty"`
+	Service     string `json:"service,omitempty"`
+	Expiration  int64  `json:"expiration,omitempty"`
+	// Firewall comment of the term, for term events
+	Term  string `json:"term,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Fingerprint identifies a token in the audit log without recording the token
+func Fingerprint(token string) string {
+	if token == "" {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:16])
+}
+
+// Logger writes records to every sink. A nil Logger discards records.
+type Logger struct {
+	mu    sync.Mutex
+	sinks []io.WriteCloser
+}
+
+// Create a logger writing to the configured sinks
+func New(sinkConfigs []config.AuditSinkConfig) (*Logger, error) {
+	logger := &Logger{}
+	for _, sinkConfig := range sinkConfigs {
+		sink, err := openSink(sinkConfig)
+		if err != nil {
+			logger.Close()
+			return nil, fmt.Errorf("failed to open %s audit sink: %v", sinkConfig.Type, err)
+		}
+		logger.sinks = append(logger.sinks, sink)
+	}
+	return logger, nil
+}
+
+func openSink(sinkConfig config.AuditSinkConfig) (io.WriteCloser, error) {
+	switch sinkConfig.Type {
+	case config.AUDIT_SINK_STDOUT:
+		return nopCloser{os.Stdout}, nil
+	case config.AUDIT_SINK_FILE:
+		return openRotatingFile(sinkConfig.Path, int64(sinkConfig.MaxSizeMB)*1024*1024, sinkConfig.MaxBackups)
+	case config.AUDIT_SINK_SYSLOG:
+		return openSyslog(sinkConfig)
+	default:
+		return nil, fmt.Errorf("unknown sink type %s", sinkConfig.Type)
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// Log writes the record to every sink, setting its time if unset
+func (l *Logger) Log(record Record) {
+	if l == nil {
+		return
+	}
+	if record.Time.IsZero() {
+		record.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("failed to encode audit record: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, sink := range l.sinks {
+		if _, err := sink.Write(line); err != nil {
+			log.Printf("failed to write audit record: %v", err)
+		}
+	}
+}
+
+// Close every sink
+func (l *Logger) Close() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, sink := range l.sinks {
+		sink.Close()
+	}
+	l.sinks = nil
+}
@@ -0,0 +1,109 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/micrictor/jpat/internal/config"
+)
+
+func readRecords(t *testing.T, path string) []Record {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	logger, err := New([]config.AuditSinkConfig{{Type: config.AUDIT_SINK_FILE, Path: path}})
+	if err != nil {
+		t.Fatalf("failed to create logger: %v", err)
+	}
+	logger.Log(Record{Event: EVENT_DECISION, Source: "192.0.2.1", Subject: "alice", Decision: DECISION_AUTHORIZED, Expiration: 1700000000})
+	logger.Log(Record{Event: EVENT_TERM_APPLIED, Term: "jpat:192.0.2.1/32;exp=1700000000"})
+	logger.Close()
+
+	records := readRecords(t, path)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	if records[0].Subject != "alice" || records[0].Decision != DECISION_AUTHORIZED || records[0].Time.IsZero() {
+		t.Errorf("unexpected record %+v", records[0])
+	}
+	if records[1].Event != EVENT_TERM_APPLIED {
+		t.Errorf("unexpected record %+v", records[1])
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	file, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+	}
+	file.Close()
+
+	expected := map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"}
+	for name, content := range expected {
+		data, err := os.ReadFile(name)
+		if err != nil || string(data) != content {
+			t.Errorf("%s contains %q, expected %q (%v)", name, data, content, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 backups to be kept")
+	}
+}
+
+func TestRotatingFileRenameFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	// The backup can't replace a directory
+	if err := os.MkdirAll(filepath.Join(path+".1", "full"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	file, err := openRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	for _, line := range []string{"first\n", "second\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatalf("failed to write after a failed rotation: %v", err)
+		}
+	}
+	file.Close()
+
+	if data, _ := os.ReadFile(path); string(data) != "first\nsecond\n" {
+		t.Errorf("%s contains %q, expected both records", path, data)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	fingerprint := Fingerprint("header.payload.signature")
+	if len(fingerprint) != 32 || strings.Contains(fingerprint, "payload") {
+		t.Errorf("unexpected fingerprint %s", fingerprint)
+	}
+	if Fingerprint("header.payload.signature") != fingerprint || Fingerprint("other") == fingerprint {
+		t.Errorf("fingerprints must identify the token")
+	}
+}
@@ -0,0 +1,84 @@
+package audit
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// rotatingFile appends to a file, renaming it to path.1, path.2... once it
+// reaches maxSize. Only maxBackups old files are kept.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	size int64
+}
+
+// Callers must serialize writes, which Logger does
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(data []byte) (int, error) {
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(data)) > f.maxSize {
+		// Keep appending to the full file rather than lose records
+		if err := f.rotate(); err != nil {
+			log.Printf("failed to rotate %s: %v", f.path, err)
+		}
+	}
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	return n, err
+}
+
+// Move the file aside and start a new one. On failure the file at path is
+// reopened, so writes can continue.
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	err := f.shift()
+	if openErr := f.open(); err == nil {
+		err = openErr
+	} else if openErr != nil {
+		err = fmt.Errorf("%v, and failed to reopen: %v", err, openErr)
+	}
+	return err
+}
+
+func (f *rotatingFile) shift() error {
+	if f.maxBackups > 0 {
+		for i := f.maxBackups - 1; i >= 1; i-- {
+			os.Rename(backupName(f.path, i), backupName(f.path, i+1))
+		}
+		return os.Rename(f.path, backupName(f.path, 1))
+	}
+	return os.Remove(f.path)
+}
+
+func backupName(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package audit
+
+import (
+	"io"
+	"log/syslog"
+
+	"github.com/micrictor/jpat/internal/config"
+)
+
+// Open a syslog writer, to the local daemon unless an address is configured
+func openSyslog(sinkConfig config.AuditSinkConfig) (io.WriteCloser, error) {
+	tag := sinkConfig.Tag
+	if tag == "" {
+		tag = config.DEFAULT_AUDIT_SYSLOG_TAG
+	}
+	return syslog.Dial(sinkConfig.Network, sinkConfig.Address, syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+}
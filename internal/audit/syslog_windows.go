@@ -0,0 +1,14 @@
+//go:build windows
+
+package audit
+
+import (
+	"errors"
+	"io"
+
+	"github.com/micrictor/jpat/internal/config"
+)
+
+func openSyslog(config.AuditSinkConfig) (io.WriteCloser, error) {
+	return nil, errors.New("syslog is not supported on Windows")
+}
@@ -5,79 +5,581 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt"
+	"github.com/micrictor/jpat/internal/jwks"
 	"gopkg.in/yaml.v2"
 )
 
 const DEFAULT_TTL = 60
+const DEFAULT_PROTOCOL = "tcp"
+
+// Name given to the service declared with the single service key, which is
+// selected by requests that don't name a service
+const DEFAULT_SERVICE = "default"
+const DEFAULT_SOURCE_CLAIM = "cidr"
+
+const FIREWALL_IPTABLES = "iptables"
+const FIREWALL_NFTABLES = "nftables"
+const FIREWALL_WFP = "wfp"
+const FIREWALL_MEMORY = "memory"
+
+const DEFAULT_RECONCILE_INTERVAL = Duration(time.Minute)
+const DEFAULT_FRESHNESS_WINDOW = Duration(30 * time.Second)
+const DEFAULT_UDP_WORKERS = 8
+const DEFAULT_UDP_QUEUE_SIZE = 1024
+
+const AUDIT_SINK_FILE = "file"
+const AUDIT_SINK_STDOUT = "stdout"
+const AUDIT_SINK_SYSLOG = "syslog"
+const DEFAULT_AUDIT_MAX_SIZE_MB = 100
+const DEFAULT_AUDIT_MAX_BACKUPS = 5
+const DEFAULT_AUDIT_SYSLOG_TAG = "jpat"
+const DEFAULT_ADMIN_SOCKET = "/run/jpat/admin.sock"
+
+// Duration allows durations to be written as strings such as "30s" in YAML
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// PortRange is an inclusive range of ports. In YAML it is written either as a
+// single port such as 21, or as a range such as "30000-30100".
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+func ParsePortRange(value string) (PortRange, error) {
+	from, to := value, value
+	if idx := strings.Index(value, "-"); idx >= 0 {
+		from, to = value[:idx], value[idx+1:]
+	}
+	start, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port %q", from)
+	}
+	end, err := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port %q", to)
+	}
+	if start == 0 || start > end {
+		return PortRange{}, fmt.Errorf("invalid port range %q", value)
+	}
+	return PortRange{From: uint16(start), To: uint16(end)}, nil
+}
+
+func (p *PortRange) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	parsed, err := ParsePortRange(value)
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
+
+func (p PortRange) String() string {
+	if p.From == p.To {
+		return strconv.Itoa(int(p.From))
+	}
+	return fmt.Sprintf("%d-%d", p.From, p.To)
+}
 
 type ServiceConfig struct {
-	Port     uint16 `yaml:"port"`
-	Host     string `yaml:"host"`
-	Protocol string `yaml:"protocol"`
-	Ttl      int64  `yaml:"ttl,omitempty"`
+	Port uint16 `yaml:"port"`
+	// Additional ports and port ranges, opened together with Port
+	Ports []PortRange `yaml:"ports,omitempty"`
+	Host  string      `yaml:"host"`
+	// Additional addresses of the service, so it can be reached over both IPv4 and IPv6
+	Hosts    []string `yaml:"hosts,omitempty"`
+	Protocol string   `yaml:"protocol"`
+	Ttl      int64    `yaml:"ttl,omitempty"`
+	// Rules applied on top of the global authorization rules for this service
+	Authorization AuthorizationConfig `yaml:"authorization,omitempty"`
+	// The key of the service in the services map
+	Name string `yaml:"-"`
+}
+
+// Addresses returns Host followed by Hosts. Invalid addresses are skipped.
+func (s ServiceConfig) Addresses() []net.IP {
+	var addresses []net.IP
+	for _, host := range append([]string{s.Host}, s.Hosts...) {
+		if ip := net.ParseIP(host); ip != nil {
+			addresses = append(addresses, ip)
+		}
+	}
+	return addresses
+}
+
+// PortRanges returns Port followed by Ports
+func (s ServiceConfig) PortRanges() []PortRange {
+	var ports []PortRange
+	if s.Port != 0 {
+		ports = append(ports, PortRange{From: s.Port, To: s.Port})
+	}
+	return append(ports, s.Ports...)
+}
+
+// AddressFor returns the first address of the service in the same family as source
+func (s ServiceConfig) AddressFor(source net.IP) (net.IP, bool) {
+	isV4 := source.To4() != nil
+	for _, address := range s.Addresses() {
+		if (address.To4() != nil) == isV4 {
+			return address, true
+		}
+	}
+	return nil, false
 }
 
 type JwtAlgorithm struct {
-	GetKeyFunc func(config VerificationConfig) jwt.Keyfunc
+	GetKeyFunc func(config VerificationConfig) (jwt.Keyfunc, error)
 }
 
-var SUPPORTED_ALGOS = map[string]JwtAlgorithm{
-	"rs256": {
-		GetKeyFunc: func(config VerificationConfig) jwt.Keyfunc {
+// Build an algorithm that verifies tokens using a PEM-encoded public key.
+// The key is read from publicKeyFiles[name], falling back to publicKeyFile, once
+// when the config is built.
+func pemAlgorithm(name string, description string, parseKey func([]byte) (interface{}, error)) JwtAlgorithm {
+	return JwtAlgorithm{
+		GetKeyFunc: func(config VerificationConfig) (jwt.Keyfunc, error) {
+			keyFile := config.PublicKeyFiles[name]
+			if keyFile == "" {
+				keyFile = config.PublicKeyFile
+			}
+			if keyFile == "" {
+				return nil, fmt.Errorf("jwt algo %s (%s) requires publicKeyFile to be set", name, description)
+			}
+			data, err := os.ReadFile(keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s public key: %v", name, err)
+			}
+			key, err := parseKey(data)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s public key %s: %v", name, keyFile, err)
+			}
+
 			return func(token *jwt.Token) (interface{}, error) {
-				if config.PublicKeyFile == "" {
-					return nil, fmt.Errorf("jwt algo rs256 (RSA with SHA256) requires publicKeyFile to be set")
-				}
-				if strings.ToLower(token.Method.Alg()) != "rs256" {
-					return nil, fmt.Errorf("token uses algo %s, expected rs256", token.Method.Alg())
+				if strings.ToLower(token.Method.Alg()) != name {
+					return nil, fmt.Errorf("token uses algo %s, expected %s", token.Method.Alg(), name)
 				}
+				return key, nil
+			}, nil
+		},
+	}
+}
 
-				fileHandle, err := os.Open(config.PublicKeyFile)
-				if err != nil {
-					return nil, err
-				}
+func parseRSAPublicKey(data []byte) (interface{}, error) {
+	return jwt.ParseRSAPublicKeyFromPEM(data)
+}
 
-				buf := new(bytes.Buffer)
-				buf.ReadFrom(fileHandle)
+func parseECPublicKey(data []byte) (interface{}, error) {
+	return jwt.ParseECPublicKeyFromPEM(data)
+}
 
-				return buf.Bytes(), nil
-			}
-		},
-	},
+func parseEdPublicKey(data []byte) (interface{}, error) {
+	return jwt.ParseEdPublicKeyFromPEM(data)
+}
+
+// Token algorithms verified with JWKS keys, unless jwksAlgos is set
+var DEFAULT_JWKS_ALGOS = []string{"rs256", "es256"}
+
+// Token algorithms that can be allowed in jwksAlgos
+var JWKS_SUPPORTED_ALGOS = map[string]bool{
+	"rs256": true, "rs384": true, "rs512": true,
+	"ps256": true, "ps384": true, "ps512": true,
+	"es256": true, "es384": true, "es512": true,
+	"eddsa": true,
+}
+
+var SUPPORTED_ALGOS = map[string]JwtAlgorithm{
+	"rs256": pemAlgorithm("rs256", "RSA with SHA256", parseRSAPublicKey),
+	"ps256": pemAlgorithm("ps256", "RSA-PSS with SHA256", parseRSAPublicKey),
+	"ps384": pemAlgorithm("ps384", "RSA-PSS with SHA384", parseRSAPublicKey),
+	"ps512": pemAlgorithm("ps512", "RSA-PSS with SHA512", parseRSAPublicKey),
+	"es256": pemAlgorithm("es256", "ECDSA P-256 with SHA256", parseECPublicKey),
+	"es384": pemAlgorithm("es384", "ECDSA P-384 with SHA384", parseECPublicKey),
+	"es512": pemAlgorithm("es512", "ECDSA P-521 with SHA512", parseECPublicKey),
+	"eddsa": pemAlgorithm("eddsa", "Ed25519", parseEdPublicKey),
 	"hs256": {
-		GetKeyFunc: func(config VerificationConfig) jwt.Keyfunc {
+		GetKeyFunc: func(config VerificationConfig) (jwt.Keyfunc, error) {
+			if config.Secret == "" {
+				return nil, fmt.Errorf("jwt algo hs256 (HMAC SHA256) requires secret to be set")
+			}
 			return func(token *jwt.Token) (interface{}, error) {
-				if config.Secret == "" {
-					return nil, fmt.Errorf("jwt algo hs256 (HMAC SHA256) requires secret to be set")
-				}
 				if strings.ToLower(token.Method.Alg()) != "hs256" {
 					return nil, fmt.Errorf("token uses algo %s, expected hs256", token.Method.Alg())
 				}
 
 				return []byte(config.Secret), nil
+			}, nil
+		},
+	},
+	"jwks": {
+		GetKeyFunc: func(config VerificationConfig) (jwt.Keyfunc, error) {
+			source := config.JwksUrl
+			if source == "" {
+				source = config.JwksFile
 			}
+			keySet, err := jwks.New(source, time.Duration(config.JwksRefresh), nil)
+			if err != nil {
+				return nil, fmt.Errorf("jwks verification is misconfigured: %v", err)
+			}
+			return keySet.Keyfunc, nil
 		},
 	},
 }
 
 type VerificationConfig struct {
-	Algo          string `yaml:"algo"`
-	PublicKeyFile string `yaml:"publicKeyFile,omitempty"`
-	Secret        string `yaml:"secret,omitempty"`
+	Algo string `yaml:"algo,omitempty"`
+	// Algos allows several algorithms at once. Tokens are verified by the entry matching
+	// their alg header, falling back to jwks if it is listed.
+	Algos          []string          `yaml:"algos,omitempty"`
+	PublicKeyFile  string            `yaml:"publicKeyFile,omitempty"`
+	PublicKeyFiles map[string]string `yaml:"publicKeyFiles,omitempty"`
+	Secret         string            `yaml:"secret,omitempty"`
+	// Only used by the jwks algo. Exactly one of JwksUrl or JwksFile should be set.
+	JwksUrl     string   `yaml:"jwksUrl,omitempty"`
+	JwksFile    string   `yaml:"jwksFile,omitempty"`
+	JwksRefresh Duration `yaml:"jwksRefresh,omitempty"`
+	// Token algorithms that may be verified with JWKS keys. Defaults to DEFAULT_JWKS_ALGOS.
+	JwksAlgos []string `yaml:"jwksAlgos,omitempty"`
+	// SourceClaim names the claim listing the networks a token may be used from.
+	SourceClaim        string `yaml:"sourceClaim,omitempty"`
+	RequireSourceClaim bool   `yaml:"requireSourceClaim,omitempty"`
+	// If set, the iss claim must be one of Issuers and the aud claim must include Audience.
+	Issuers  []string `yaml:"issuers,omitempty"`
+	Audience string   `yaml:"audience,omitempty"`
+	// Leeway is the clock skew allowed when checking exp, nbf and iat.
+	Leeway Duration `yaml:"leeway,omitempty"`
+}
+
+// Returns the lowercased union of Algo and Algos
+func (v VerificationConfig) allowedAlgos() []string {
+	var algos []string
+	seen := make(map[string]bool)
+	for _, name := range append([]string{v.Algo}, v.Algos...) {
+		name = strings.ToLower(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		algos = append(algos, name)
+	}
+	return algos
+}
+
+// Returns the lowercased JwksAlgos, or DEFAULT_JWKS_ALGOS if none are set
+func (v VerificationConfig) jwksAlgos() []string {
+	if len(v.JwksAlgos) == 0 {
+		return DEFAULT_JWKS_ALGOS
+	}
+	algos := make([]string, len(v.JwksAlgos))
+	for i, name := range v.JwksAlgos {
+		algos[i] = strings.ToLower(name)
+	}
+	return algos
+}
+
+// Build a keyfunc that dispatches to the allowed algorithm matching the token's
+// alg header, falling back to jwks for the algorithms in jwksAlgos. Tokens using
+// any other algorithm are rejected. Fails if a key can't be loaded.
+func getKeyfunc(verification VerificationConfig) (jwt.Keyfunc, error) {
+	algos := verification.allowedAlgos()
+	keyfuncs := make(map[string]jwt.Keyfunc)
+	for _, name := range algos {
+		keyfunc, err := SUPPORTED_ALGOS[name].GetKeyFunc(verification)
+		if err != nil {
+			return nil, err
+		}
+		keyfuncs[name] = keyfunc
+	}
+	if jwksKeyfunc, ok := keyfuncs["jwks"]; ok {
+		delete(keyfuncs, "jwks")
+		for _, name := range verification.jwksAlgos() {
+			if _, ok := keyfuncs[name]; !ok {
+				keyfuncs[name] = jwksKeyfunc
+			}
+		}
+	}
+
+	return func(token *jwt.Token) (interface{}, error) {
+		if keyfunc, ok := keyfuncs[strings.ToLower(token.Method.Alg())]; ok {
+			return keyfunc(token)
+		}
+		return nil, fmt.Errorf("token uses algo %s, expected one of %v", token.Method.Alg(), algos)
+	}, nil
+}
+
+// ClaimRule is a single condition evaluated against a token claim.
+// Exactly one of Equals, Prefix, Contains, Excludes or Present should be set.
+type ClaimRule struct {
+	Name     string `yaml:"name,omitempty"`
+	Claim    string `yaml:"claim"`
+	Equals   string `yaml:"equals,omitempty"`
+	Prefix   string `yaml:"prefix,omitempty"`
+	Contains string `yaml:"contains,omitempty"`
+	Excludes string `yaml:"excludes,omitempty"`
+	Present  *bool  `yaml:"present,omitempty"`
+}
+
+func (c ClaimRule) String() string {
+	switch {
+	case c.Equals != "":
+		return fmt.Sprintf("%s equals %q", c.Claim, c.Equals)
+	case c.Prefix != "":
+		return fmt.Sprintf("%s prefix %q", c.Claim, c.Prefix)
+	case c.Contains != "":
+		return fmt.Sprintf("%s contains %q", c.Claim, c.Contains)
+	case c.Excludes != "":
+		return fmt.Sprintf("%s excludes %q", c.Claim, c.Excludes)
+	case c.Present != nil:
+		return fmt.Sprintf("%s present=%v", c.Claim, *c.Present)
+	}
+	return c.Claim
+}
+
+func (c ClaimRule) validate() error {
+	if c.Claim == "" {
+		return fmt.Errorf("rule %q has no claim", c.Name)
+	}
+	operators := 0
+	for _, set := range []bool{c.Equals != "", c.Prefix != "", c.Contains != "", c.Excludes != "", c.Present != nil} {
+		if set {
+			operators++
+		}
+	}
+	if operators != 1 {
+		return fmt.Errorf("rule for claim %s must set exactly one of equals, prefix, contains, excludes or present", c.Claim)
+	}
+	return nil
+}
+
+// AuthorizationConfig holds the claim rules a token must satisfy.
+// Every require rule must match, and no deny rule may match.
+type AuthorizationConfig struct {
+	Require []ClaimRule `yaml:"require,omitempty"`
+	Deny    []ClaimRule `yaml:"deny,omitempty"`
+}
+
+func (a AuthorizationConfig) mustValidate() {
+	for _, rules := range [][]ClaimRule{a.Require, a.Deny} {
+		for _, rule := range rules {
+			if err := rule.validate(); err != nil {
+				log.Panicf("invalid authorization rule: %s", err.Error())
+			}
+		}
+	}
+}
+
+// ReplayConfig controls the replay guard, which requires every token to carry a jti
+// and rejects jti values that have already been used.
+type ReplayConfig struct {
+	Enabled    bool `yaml:"enabled"`
+	MaxEntries int  `yaml:"maxEntries,omitempty"`
+	// Allow a jti to be reused from the source address that first presented it.
+	AllowSameSource bool `yaml:"allowSameSource,omitempty"`
+}
+
+// FirewallConfig selects how terms are programmed into the host firewall.
+// If Backend is empty, the platform default is used: iptables on Linux and
+// the Windows Filtering Platform (wfp) on Windows. The memory backend only
+// records terms, without changing the host firewall.
+type FirewallConfig struct {
+	Backend string `yaml:"backend,omitempty"`
+	// If set, active terms are saved to StateFile so they can be cleaned up after a crash
+	StateFile string `yaml:"stateFile,omitempty"`
+	// How often the firewall is scanned for jpat rules the server doesn't know about
+	ReconcileInterval Duration `yaml:"reconcileInterval,omitempty"`
+	// The iptables chain holding jpat's rules, jumped to from INPUT. Defaults to JPAT.
+	Chain string `yaml:"chain,omitempty"`
+	// 1-based position of the jump rule in INPUT. Defaults to 1, the top of the chain.
+	JumpPosition int `yaml:"jumpPosition,omitempty"`
+	// Drop traffic to the service that no term accepts. The nftables backend always does.
+	DropUnmatched bool `yaml:"dropUnmatched,omitempty"`
+}
+
+// GrpcConfig enables the gRPC listener, which serves the same requests as the UDP
+// listener over TLS. It is disabled unless Listen is set.
+type GrpcConfig struct {
+	// Address to listen on, such as ":8443"
+	Listen   string `yaml:"listen,omitempty"`
+	CertFile string `yaml:"certFile,omitempty"`
+	KeyFile  string `yaml:"keyFile,omitempty"`
+	// If set, clients must present a certificate signed by a CA in this file
+	ClientCAFile string `yaml:"clientCaFile,omitempty"`
+}
+
+// ErrorReplyConfig controls what clients are told about rejected requests.
+// By default they get a status and a message explaining it.
+type ErrorReplyConfig struct {
+	// Send no UDP reply at all to rejected requests
+	Silent bool `yaml:"silent,omitempty"`
+	// Only tell clients that the request was denied, without saying why
+	HideDetails bool `yaml:"hideDetails,omitempty"`
+}
+
+// SigningConfig gives the server a key to sign its replies with, so clients that
+// pin the matching public key can detect spoofed replies.
+type SigningConfig struct {
+	// PEM-encoded PKCS #8 Ed25519 private key
+	PrivateKeyFile string `yaml:"privateKeyFile,omitempty"`
+}
+
+// EnvelopeConfig lets clients seal their requests to the server, hiding tokens
+// on the wire.
+type EnvelopeConfig struct {
+	// Base64 X25519 private key, as written by wg genkey
+	PrivateKeyFile string `yaml:"privateKeyFile,omitempty"`
+	// Reject plaintext requests. Leave unset while clients migrate.
+	Required bool `yaml:"required,omitempty"`
+}
+
+// FreshnessConfig requires every request to carry a recent timestamp and an unused
+// nonce, bound to the token with an HMAC key shared with clients.
+type FreshnessConfig struct {
+	// Base64 HMAC key, as written by openssl rand -base64 32
+	KeyFile string `yaml:"keyFile,omitempty"`
+	// How far a request's timestamp may be from the server's clock, either way
+	Window Duration `yaml:"window,omitempty"`
+}
+
+// UdpConfig sizes the pool of workers processing UDP requests. Packets arriving
+// while the queue is full are dropped.
+type UdpConfig struct {
+	Workers   int `yaml:"workers,omitempty"`
+	QueueSize int `yaml:"queueSize,omitempty"`
+}
+
+// RateLimitConfig is a token bucket refilling at Rate requests per second. A zero
+// rate disables the limit.
+type RateLimitConfig struct {
+	Rate float64 `yaml:"rate"`
+	// Defaults to the rate, rounded up
+	Burst int `yaml:"burst,omitempty"`
+}
+
+// RateLimitsConfig limits requests before their signatures are verified
+type RateLimitsConfig struct {
+	PerSource RateLimitConfig `yaml:"perSource,omitempty"`
+	// Keyed on the unverified sub claim
+	PerSubject RateLimitConfig `yaml:"perSubject,omitempty"`
+}
+
+// MetricsConfig enables the Prometheus metrics listener
+type MetricsConfig struct {
+	// Address to serve /metrics on, such as 127.0.0.1:9337
+	Listen string `yaml:"listen,omitempty"`
+}
+
+// AuditSinkConfig is somewhere audit records are written
+type AuditSinkConfig struct {
+	// One of AUDIT_SINK_FILE, AUDIT_SINK_STDOUT or AUDIT_SINK_SYSLOG
+	Type string `yaml:"type"`
+	// For file sinks. The file is rotated once it reaches MaxSizeMB.
+	Path       string `yaml:"path,omitempty"`
+	MaxSizeMB  int    `yaml:"maxSizeMB,omitempty"`
+	MaxBackups int    `yaml:"maxBackups,omitempty"`
+	// For syslog sinks. An empty address logs to the local syslog daemon.
+	Tag     string `yaml:"tag,omitempty"`
+	Network string `yaml:"network,omitempty"`
+	Address string `yaml:"address,omitempty"`
+}
+
+// AuditConfig enables the audit log of every decision and firewall change
+type AuditConfig struct {
+	Sinks []AuditSinkConfig `yaml:"sinks,omitempty"`
+}
+
+// AdminConfig enables the admin API on a Unix socket
+type AdminConfig struct {
+	// Path of the socket, such as DEFAULT_ADMIN_SOCKET
+	Socket string `yaml:"socket,omitempty"`
 }
 
 type MarshalledConfig struct {
-	Service      ServiceConfig      `yaml:"service"`
-	Verification VerificationConfig `yaml:"verification"`
+	// A single protected service, named DEFAULT_SERVICE
+	Service       *ServiceConfig           `yaml:"service,omitempty"`
+	Services      map[string]ServiceConfig `yaml:"services,omitempty"`
+	Verification  VerificationConfig       `yaml:"verification"`
+	Authorization AuthorizationConfig      `yaml:"authorization,omitempty"`
+	Replay        ReplayConfig             `yaml:"replay,omitempty"`
+	Firewall      FirewallConfig           `yaml:"firewall,omitempty"`
+	Grpc          GrpcConfig               `yaml:"grpc,omitempty"`
+	ErrorReplies  ErrorReplyConfig         `yaml:"errorReplies,omitempty"`
+	Signing       SigningConfig            `yaml:"signing,omitempty"`
+	Envelope      EnvelopeConfig           `yaml:"envelope,omitempty"`
+	Freshness     FreshnessConfig          `yaml:"freshness,omitempty"`
+	Udp           UdpConfig                `yaml:"udp,omitempty"`
+	RateLimits    RateLimitsConfig         `yaml:"rateLimits,omitempty"`
+	Metrics       MetricsConfig            `yaml:"metrics,omitempty"`
+	Audit         AuditConfig              `yaml:"audit,omitempty"`
+	Admin         AdminConfig              `yaml:"admin,omitempty"`
 }
 
 type AppConfig struct {
-	Service ServiceConfig
-	Keyfunc jwt.Keyfunc
+	Services      map[string]ServiceConfig
+	Verification  VerificationConfig
+	Keyfunc       jwt.Keyfunc
+	Authorization AuthorizationConfig
+	Replay        ReplayConfig
+	Firewall      FirewallConfig
+	Grpc          GrpcConfig
+	ErrorReplies  ErrorReplyConfig
+	Signing       SigningConfig
+	Envelope      EnvelopeConfig
+	Freshness     FreshnessConfig
+	Udp           UdpConfig
+	RateLimits    RateLimitsConfig
+	Metrics       MetricsConfig
+	Audit         AuditConfig
+	Admin         AdminConfig
+}
+
+// UnknownServiceError is returned when a request names a service that isn't configured
+type UnknownServiceError struct {
+	Name string
+}
+
+func (e *UnknownServiceError) Error() string {
+	return fmt.Sprintf("unknown service %q", e.Name)
+}
+
+// Service returns the service a request asked for. An empty name selects
+// DEFAULT_SERVICE, or the only service if just one is configured.
+func (c *AppConfig) Service(name string) (ServiceConfig, error) {
+	if name == "" {
+		if len(c.Services) == 1 {
+			for _, service := range c.Services {
+				return service, nil
+			}
+		}
+		name = DEFAULT_SERVICE
+	}
+	service, ok := c.Services[name]
+	if !ok {
+		return ServiceConfig{}, &UnknownServiceError{Name: name}
+	}
+	return service, nil
 }
 
 var config *AppConfig
@@ -90,18 +592,133 @@ func getConfig(data []byte) (config *AppConfig, err error) {
 		log.Panicf("failed to unmarshal config: %s", err.Error())
 	}
 
-	algo, ok := SUPPORTED_ALGOS[strings.ToLower(tempConfig.Verification.Algo)]
-	if !ok {
-		log.Panicf("unsupported algorithm %s", tempConfig.Verification.Algo)
+	algos := tempConfig.Verification.allowedAlgos()
+	if len(algos) == 0 {
+		log.Panicf("no verification algorithm configured")
+	}
+	for _, name := range algos {
+		if _, ok := SUPPORTED_ALGOS[name]; !ok {
+			log.Panicf("unsupported algorithm %s", name)
+		}
+		if name == "jwks" && (tempConfig.Verification.JwksUrl == "") == (tempConfig.Verification.JwksFile == "") {
+			log.Panicf("jwks verification requires exactly one of jwksUrl or jwksFile")
+		}
+	}
+	for _, name := range tempConfig.Verification.jwksAlgos() {
+		if !JWKS_SUPPORTED_ALGOS[name] {
+			log.Panicf("unsupported jwks algorithm %s", name)
+		}
 	}
 
-	if tempConfig.Service.Ttl == 0 {
-		tempConfig.Service.Ttl = DEFAULT_TTL
+	tempConfig.Authorization.mustValidate()
+	keyfunc, err := getKeyfunc(tempConfig.Verification)
+	if err != nil {
+		log.Panicf("invalid verification config: %s", err.Error())
+	}
+
+	if tempConfig.Verification.SourceClaim == "" {
+		tempConfig.Verification.SourceClaim = DEFAULT_SOURCE_CLAIM
+	}
+
+	switch tempConfig.Firewall.Backend {
+	case "", FIREWALL_IPTABLES, FIREWALL_NFTABLES, FIREWALL_WFP, FIREWALL_MEMORY:
+	default:
+		log.Panicf("unsupported firewall backend %s", tempConfig.Firewall.Backend)
+	}
+	if tempConfig.Firewall.JumpPosition < 0 {
+		log.Panicf("firewall jumpPosition must be positive, got %d", tempConfig.Firewall.JumpPosition)
+	}
+
+	if tempConfig.Grpc.Listen != "" && (tempConfig.Grpc.CertFile == "" || tempConfig.Grpc.KeyFile == "") {
+		log.Panicf("the grpc listener requires certFile and keyFile")
+	}
+	if tempConfig.Envelope.Required && tempConfig.Envelope.PrivateKeyFile == "" {
+		log.Panicf("requiring sealed requests requires envelope.privateKeyFile")
+	}
+	if tempConfig.Freshness.Window < 0 {
+		log.Panicf("freshness window can't be negative")
+	}
+	if tempConfig.Udp.Workers == 0 {
+		tempConfig.Udp.Workers = DEFAULT_UDP_WORKERS
+	}
+	if tempConfig.Udp.QueueSize == 0 {
+		tempConfig.Udp.QueueSize = DEFAULT_UDP_QUEUE_SIZE
+	}
+	if tempConfig.Udp.Workers < 0 || tempConfig.Udp.QueueSize < 0 {
+		log.Panicf("udp workers and queueSize must be positive")
+	}
+	if tempConfig.RateLimits.PerSource.Rate < 0 || tempConfig.RateLimits.PerSubject.Rate < 0 {
+		log.Panicf("rate limits can't be negative")
+	}
+	for i := range tempConfig.Audit.Sinks {
+		sink := &tempConfig.Audit.Sinks[i]
+		switch sink.Type {
+		case AUDIT_SINK_FILE:
+			if sink.Path == "" {
+				log.Panicf("audit file sinks require a path")
+			}
+			if sink.MaxSizeMB == 0 {
+				sink.MaxSizeMB = DEFAULT_AUDIT_MAX_SIZE_MB
+			}
+			if sink.MaxBackups == 0 {
+				sink.MaxBackups = DEFAULT_AUDIT_MAX_BACKUPS
+			}
+		case AUDIT_SINK_STDOUT, AUDIT_SINK_SYSLOG:
+		default:
+			log.Panicf("unsupported audit sink %s", sink.Type)
+		}
+	}
+
+	services := make(map[string]ServiceConfig)
+	for name, service := range tempConfig.Services {
+		services[name] = service
+	}
+	if tempConfig.Service != nil {
+		if _, ok := services[DEFAULT_SERVICE]; ok {
+			log.Panicf("service and services.%s can't both be set", DEFAULT_SERVICE)
+		}
+		services[DEFAULT_SERVICE] = *tempConfig.Service
+	}
+	if len(services) == 0 {
+		log.Panicf("no services configured")
+	}
+	for name, service := range services {
+		if name == "" {
+			log.Panicf("service names can't be empty")
+		}
+		service.Name = name
+		for _, host := range append([]string{service.Host}, service.Hosts...) {
+			if net.ParseIP(host) == nil {
+				log.Panicf("service %s host %q is not an IP address", name, host)
+			}
+		}
+		service.Authorization.mustValidate()
+		if service.Ttl == 0 {
+			service.Ttl = DEFAULT_TTL
+		}
+		if service.Protocol == "" {
+			service.Protocol = DEFAULT_PROTOCOL
+		}
+		services[name] = service
 	}
 
 	return &AppConfig{
-		Service: tempConfig.Service,
-		Keyfunc: algo.GetKeyFunc(tempConfig.Verification),
+		Services:      services,
+		Verification:  tempConfig.Verification,
+		Keyfunc:       keyfunc,
+		Authorization: tempConfig.Authorization,
+		Replay:        tempConfig.Replay,
+		Firewall:      tempConfig.Firewall,
+		Grpc:          tempConfig.Grpc,
+		ErrorReplies:  tempConfig.ErrorReplies,
+		Signing:       tempConfig.Signing,
+		Envelope:      tempConfig.Envelope,
+		Freshness:     tempConfig.Freshness,
+		Udp:           tempConfig.Udp,
+		RateLimits:    tempConfig.RateLimits,
+		Metrics:       tempConfig.Metrics,
+		Audit:         tempConfig.Audit,
+		Admin:         tempConfig.Admin,
 	}, nil
 }
 
@@ -118,14 +735,149 @@ func New(reader io.Reader) *AppConfig {
 	if err != nil {
 		log.Fatalf("Failed to parse config: %s", err.Error())
 	}
+	if err := checkServices(result); err != nil {
+		log.Fatalf("Config %s", err.Error())
+	}
 
-	if result.Service.Host == "" || result.Service.Port == 0 || result.Service.Ttl == 0 {
-		log.Fatalf("Config service definition is invalid: %v", result.Service)
+	config = result
+	return config
+}
+
+func checkServices(appConfig *AppConfig) error {
+	names := make([]string, 0, len(appConfig.Services))
+	for name, service := range appConfig.Services {
+		if service.Host == "" || len(service.PortRanges()) == 0 || service.Ttl == 0 {
+			return fmt.Errorf("service definition %s is invalid: %v", name, service)
+		}
+		names = append(names, name)
+	}
+
+	// Each service's firewall rules drop everything on its ports that it didn't
+	// authorize, so services can't share a port on one address
+	sort.Strings(names)
+	for i, name := range names {
+		for _, other := range names[i+1:] {
+			if err := checkOverlap(appConfig.Services[name], appConfig.Services[other]); err != nil {
+				return fmt.Errorf("services %s and %s overlap: %v", name, other, err)
+			}
+		}
+	}
+	return nil
+}
+
+func checkOverlap(a ServiceConfig, b ServiceConfig) error {
+	if !strings.EqualFold(a.Protocol, b.Protocol) {
+		return nil
 	}
-	if result.Service.Protocol == "" {
-		result.Service.Protocol = "tcp"
+	for _, addressA := range a.Addresses() {
+		for _, addressB := range b.Addresses() {
+			if !addressA.Equal(addressB) {
+				continue
+			}
+			for _, portA := range a.PortRanges() {
+				for _, portB := range b.PortRanges() {
+					if portA.From <= portB.To && portB.From <= portA.To {
+						return fmt.Errorf("both use %s port %v on %v", a.Protocol, portA, addressA)
+					}
+				}
+			}
+		}
 	}
+	return nil
+}
 
+// Parse a config without touching the one returned by New. Errors that would
+// stop the server at startup are returned instead.
+func Parse(reader io.Reader) (result *AppConfig, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			result, err = nil, fmt.Errorf("%v", r)
+		}
+	}()
+
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(reader); err != nil {
+		return nil, err
+	}
+	result, err = getConfig(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkServices(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Reload parses a new config and passes it to apply. Only if both succeed does
+// the new config replace the one returned by New, so a bad config leaves the
+// running one in place.
+func Reload(reader io.Reader, apply func(*AppConfig) error) (*AppConfig, error) {
+	result, err := Parse(reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := apply(result); err != nil {
+		return nil, err
+	}
 	config = result
-	return config
+	return result, nil
+}
+
+// RestartRequired names the sections that differ between c and next but are only
+// read at startup, such as listeners and the firewall backend. Services are
+// included if their names, addresses, ports or protocols change, as the firewall's
+// address families and drop rules are set up for them.
+func (c *AppConfig) RestartRequired(next *AppConfig) []string {
+	sections := []struct {
+		name          string
+		current, next interface{}
+	}{
+		{"services", firewallServices(c.Services), firewallServices(next.Services)},
+		{"firewall", c.Firewall, next.Firewall},
+		{"grpc", c.Grpc, next.Grpc},
+		{"udp", c.Udp, next.Udp},
+		{"metrics", c.Metrics, next.Metrics},
+		{"audit", c.Audit, next.Audit},
+		{"admin", c.Admin, next.Admin},
+	}
+	var changed []string
+	for _, section := range sections {
+		if !reflect.DeepEqual(section.current, section.next) {
+			changed = append(changed, section.name)
+		}
+	}
+	return changed
+}
+
+// The parts of a service the firewall is set up for
+type serviceFirewall struct {
+	Host     string
+	Hosts    []string
+	Port     uint16
+	Ports    []PortRange
+	Protocol string
+}
+
+func firewallServices(services map[string]ServiceConfig) map[string]serviceFirewall {
+	result := make(map[string]serviceFirewall, len(services))
+	for name, service := range services {
+		result[name] = serviceFirewall{service.Host, service.Hosts, service.Port, service.Ports, service.Protocol}
+	}
+	return result
+}
+
+// StartedServices returns the services c was started with, taking the TTL and
+// authorization rules of each from next. Services added in next are left out and
+// removed ones are kept, until a restart sets the firewall up for them.
+func (c *AppConfig) StartedServices(next *AppConfig) map[string]ServiceConfig {
+	services := make(map[string]ServiceConfig, len(c.Services))
+	for name, service := range c.Services {
+		if updated, ok := next.Services[name]; ok {
+			service.Ttl = updated.Ttl
+			service.Authorization = updated.Authorization
+		}
+		services[name] = service
+	}
+	return services
 }
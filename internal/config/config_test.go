@@ -2,10 +2,25 @@ package config
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
 )
 
 const YAML_HEADER = "---\n"
@@ -24,13 +39,21 @@ const VERIFICATION_CONFIG = `
 `
 
 func TestNew(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPublic, _, _ := ed25519.GenerateKey(rand.Reader)
+	rsaFile := writePublicKey(t, "rsa", &rsaKey.PublicKey)
+
 	testCases := []struct {
 		algo          string
 		publicKeyFile string
 		secret        string
 	}{
-		{"rs256", "/a/file", ""},
+		{"rs256", rsaFile, ""},
 		{"hs256", "", "secretstring"},
+		{"es256", writePublicKey(t, "ec", &ecKey.PublicKey), ""},
+		{"eddsa", writePublicKey(t, "ed", edPublic), ""},
+		{"ps512", rsaFile, ""},
 	}
 	for _, tc := range testCases {
 		inputBuffer := new(bytes.Buffer)
@@ -43,12 +66,15 @@ func TestNew(t *testing.T) {
 		testConfig := New(inputBuffer)
 
 		expectedService := ServiceConfig{
-			Host: "127.0.0.1",
-			Port: 1337,
-			Ttl:  60,
+			Name:     DEFAULT_SERVICE,
+			Host:     "127.0.0.1",
+			Port:     1337,
+			Protocol: "tcp",
+			Ttl:      60,
 		}
-		if testConfig.Service != expectedService {
-			t.Errorf("Service %v does not match expected service %v", testConfig.Service, expectedService)
+		service, err := testConfig.Service("")
+		if err != nil || !reflect.DeepEqual(service, expectedService) {
+			t.Errorf("Service %v does not match expected service %v", service, expectedService)
 		}
 
 		_, ok := SUPPORTED_ALGOS[tc.algo]
@@ -93,7 +119,7 @@ func TestNewSingleton(t *testing.T) {
 		publicKeyFile string
 		secret        string
 	}{
-		{"rs256", "/a/file", ""},
+		{"hs256", "", "secretstring"},
 		{"notarealalgo", "badconfig", "badconfig"},
 	}
 	var configList []*AppConfig
@@ -112,3 +138,392 @@ func TestNewSingleton(t *testing.T) {
 		t.Errorf("Configs do not match")
 	}
 }
+
+const MULTI_ALGO_CONFIG = `
+  verification:
+    algos: [es256, eddsa, ps256, hs256]
+    secret: secretstring
+    publicKeyFiles:
+      es256: %s
+      eddsa: %s
+      ps256: %s
+`
+
+func writePublicKey(t *testing.T, name string, publicKey interface{}) string {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatalf("failed to marshal %s key: %v", name, err)
+	}
+	path := filepath.Join(t.TempDir(), name+".pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("failed to write %s key: %v", name, err)
+	}
+	return path
+}
+
+func TestParseInvalidKeys(t *testing.T) {
+	malformed := filepath.Join(t.TempDir(), "malformed.pem")
+	if err := os.WriteFile(malformed, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	testCases := []struct {
+		name          string
+		algo          string
+		publicKeyFile string
+		secret        string
+	}{
+		{"no key file", "rs256", "", ""},
+		{"missing key file", "rs256", filepath.Join(t.TempDir(), "missing.pem"), ""},
+		{"malformed key file", "es256", malformed, ""},
+		{"wrong key type", "rs256", writePublicKey(t, "ec", &ecKey.PublicKey), ""},
+		{"no secret", "hs256", "", ""},
+	}
+	for _, tc := range testCases {
+		input := YAML_HEADER + fmt.Sprintf(SERVICE_CONFIG, 60) + fmt.Sprintf(VERIFICATION_CONFIG, tc.algo, tc.publicKeyFile, tc.secret)
+		if _, err := Parse(strings.NewReader(input)); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
+
+func TestKeyLoadedOnce(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	keyFile := writePublicKey(t, "es256", &ecKey.PublicKey)
+	parsed, err := Parse(strings.NewReader(YAML_HEADER + fmt.Sprintf(SERVICE_CONFIG, 60) + fmt.Sprintf(VERIFICATION_CONFIG, "es256", keyFile, "")))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	// Tokens are verified with the key read by Parse, without touching the disk
+	if err := os.Remove(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	signed, _ := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"exp": time.Now().Add(time.Minute).Unix()}).SignedString(ecKey)
+	if _, err := jwt.Parse(signed, parsed.Keyfunc); err != nil {
+		t.Errorf("token rejected after the key file was removed: %v", err)
+	}
+}
+
+func TestNewMultipleAlgos(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPublic, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	otherEcKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+
+	inputBuffer := new(bytes.Buffer)
+	inputBuffer.WriteString(YAML_HEADER)
+	inputBuffer.WriteString(fmt.Sprintf(SERVICE_CONFIG, 60))
+	inputBuffer.WriteString(fmt.Sprintf(MULTI_ALGO_CONFIG,
+		writePublicKey(t, "es256", &ecKey.PublicKey),
+		writePublicKey(t, "eddsa", edPublic),
+		writePublicKey(t, "ps256", &rsaKey.PublicKey),
+	))
+	config = nil
+	testConfig := New(inputBuffer)
+	defer func() { config = nil }()
+
+	testCases := []struct {
+		method jwt.SigningMethod
+		key    interface{}
+		valid  bool
+	}{
+		{jwt.SigningMethodES256, ecKey, true},
+		{jwt.SigningMethodEdDSA, edKey, true},
+		{jwt.SigningMethodPS256, rsaKey, true},
+		{jwt.SigningMethodHS256, []byte("secretstring"), true},
+		// Allowed algorithm, wrong key
+		{jwt.SigningMethodHS256, []byte("wrongsecret"), false},
+		// Algorithm not in the allowlist
+		{jwt.SigningMethodRS256, rsaKey, false},
+		{jwt.SigningMethodES384, otherEcKey, false},
+	}
+	for _, tc := range testCases {
+		token := jwt.NewWithClaims(tc.method, jwt.MapClaims{"exp": time.Now().Add(time.Minute).Unix()})
+		signed, err := token.SignedString(tc.key)
+		if err != nil {
+			t.Fatalf("failed to sign %s token: %v", tc.method.Alg(), err)
+		}
+
+		_, err = jwt.Parse(signed, testConfig.Keyfunc)
+		if tc.valid && err != nil {
+			t.Errorf("%s token rejected: %v", tc.method.Alg(), err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%s token accepted", tc.method.Alg())
+		}
+	}
+}
+
+const JWKS_CONFIG = `
+  verification:
+    algos: [hs256, jwks]
+    secret: secretstring
+    jwksFile: %s
+`
+
+func TestJwksAlgos(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	// The key has no alg, so only jwksAlgos limits the algorithms it verifies
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	document := fmt.Sprintf(`{"keys": [{"kty": "RSA", "kid": "key", "n": "%s", "e": "%s"}]}`,
+		base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()))
+	if err := os.WriteFile(jwksFile, []byte(document), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		jwksAlgos string
+		method    jwt.SigningMethod
+		valid     bool
+	}{
+		{"", jwt.SigningMethodRS256, true},
+		{"", jwt.SigningMethodRS512, false},
+		{"", jwt.SigningMethodPS512, false},
+		{"    jwksAlgos: [RS512]\n", jwt.SigningMethodRS512, true},
+		{"    jwksAlgos: [RS512]\n", jwt.SigningMethodRS256, false},
+	}
+	for _, tc := range testCases {
+		config = nil
+		testConfig := New(strings.NewReader(YAML_HEADER + fmt.Sprintf(SERVICE_CONFIG, 60) + fmt.Sprintf(JWKS_CONFIG, jwksFile) + tc.jwksAlgos))
+
+		token := jwt.NewWithClaims(tc.method, jwt.MapClaims{"exp": time.Now().Add(time.Minute).Unix()})
+		token.Header["kid"] = "key"
+		signed, err := token.SignedString(rsaKey)
+		if err != nil {
+			t.Fatalf("failed to sign %s token: %v", tc.method.Alg(), err)
+		}
+		_, err = jwt.Parse(signed, testConfig.Keyfunc)
+		if tc.valid && err != nil {
+			t.Errorf("%q: %s token rejected: %v", tc.jwksAlgos, tc.method.Alg(), err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%q: %s token accepted", tc.jwksAlgos, tc.method.Alg())
+		}
+	}
+	config = nil
+
+	if _, err := Parse(strings.NewReader(YAML_HEADER + fmt.Sprintf(SERVICE_CONFIG, 60) + fmt.Sprintf(JWKS_CONFIG, jwksFile) + "    jwksAlgos: [hs256]\n")); err == nil {
+		t.Errorf("hs256 was allowed for jwks keys")
+	}
+}
+
+func TestServiceAddressFor(t *testing.T) {
+	service := ServiceConfig{Host: "192.0.2.10", Hosts: []string{"2001:db8::10"}}
+	testCases := []struct {
+		source   string
+		expected string
+		ok       bool
+	}{
+		{"198.51.100.1", "192.0.2.10", true},
+		{"::ffff:198.51.100.1", "192.0.2.10", true},
+		{"2001:db8:1::1", "2001:db8::10", true},
+	}
+	for _, tc := range testCases {
+		address, ok := service.AddressFor(net.ParseIP(tc.source))
+		if ok != tc.ok || !address.Equal(net.ParseIP(tc.expected)) {
+			t.Errorf("AddressFor(%s) = %v, %v, expected %s", tc.source, address, ok, tc.expected)
+		}
+	}
+
+	v4Only := ServiceConfig{Host: "192.0.2.10"}
+	if _, ok := v4Only.AddressFor(net.ParseIP("2001:db8:1::1")); ok {
+		t.Errorf("IPv4-only service returned an address for an IPv6 source")
+	}
+}
+
+const SERVICES_CONFIG = `
+  services:
+    ssh:
+      host: 127.0.0.1
+      port: 22
+      ports: [2222, "30000-30100"]
+    https:
+      host: 127.0.0.1
+      port: 443
+      ttl: 300
+      authorization:
+        require:
+          - claim: roles
+            contains: web-admin
+  verification:
+    algo: hs256
+    secret: secretstring
+`
+
+func TestServicesOverlap(t *testing.T) {
+	testCases := []struct {
+		name     string
+		services string
+		err      bool
+	}{
+		{"same port", "    a: {host: 127.0.0.1, port: 22}\n    b: {host: 127.0.0.1, port: 22}\n", true},
+		{"overlapping ranges", "    a: {host: 127.0.0.1, ports: [\"30000-30100\"]}\n    b: {host: 127.0.0.1, ports: [\"30100-30200\"]}\n", true},
+		{"shared address", "    a: {host: 127.0.0.1, hosts: [\"::1\"], port: 22}\n    b: {host: 192.0.2.1, hosts: [\"::1\"], port: 22}\n", true},
+		{"other address", "    a: {host: 127.0.0.1, port: 22}\n    b: {host: 127.0.0.2, port: 22}\n", false},
+		{"other protocol", "    a: {host: 127.0.0.1, port: 53}\n    b: {host: 127.0.0.1, port: 53, protocol: udp}\n", false},
+		{"adjacent ranges", "    a: {host: 127.0.0.1, ports: [\"30000-30100\"]}\n    b: {host: 127.0.0.1, ports: [\"30101-30200\"]}\n", false},
+	}
+	for _, tc := range testCases {
+		input := YAML_HEADER + "  services:\n" + tc.services + fmt.Sprintf(VERIFICATION_CONFIG, "hs256", "", "secretstring")
+		if _, err := Parse(strings.NewReader(input)); (err != nil) != tc.err {
+			t.Errorf("%s: Parse returned %v", tc.name, err)
+		}
+	}
+}
+
+func TestNewServices(t *testing.T) {
+	config = nil
+	defer func() { config = nil }()
+	testConfig := New(strings.NewReader(YAML_HEADER + SERVICES_CONFIG))
+
+	https, err := testConfig.Service("https")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if https.Name != "https" || https.Port != 443 || https.Ttl != 300 || https.Protocol != DEFAULT_PROTOCOL {
+		t.Errorf("unexpected https service %+v", https)
+	}
+	if len(https.Authorization.Require) != 1 {
+		t.Errorf("https service authorization not parsed: %+v", https.Authorization)
+	}
+	ssh, err := testConfig.Service("ssh")
+	if err != nil || ssh.Port != 22 || ssh.Ttl != DEFAULT_TTL {
+		t.Errorf("unexpected ssh service %+v, %v", ssh, err)
+	}
+	expectedPorts := []PortRange{{22, 22}, {2222, 2222}, {30000, 30100}}
+	if ports := ssh.PortRanges(); !reflect.DeepEqual(ports, expectedPorts) {
+		t.Errorf("ssh ports %v, expected %v", ports, expectedPorts)
+	}
+
+	// Neither an unknown name nor an empty one resolves when there are several services
+	for _, name := range []string{"ftp", ""} {
+		_, err := testConfig.Service(name)
+		if _, ok := err.(*UnknownServiceError); !ok {
+			t.Errorf("Service(%q) error = %v, expected UnknownServiceError", name, err)
+		}
+	}
+}
+
+func TestNewServicesConflict(t *testing.T) {
+	input := YAML_HEADER + fmt.Sprintf(SERVICE_CONFIG, 60) + `
+  services:
+    default:
+      host: 127.0.0.1
+      port: 22
+` + fmt.Sprintf(VERIFICATION_CONFIG, "hs256", "", "secretstring")
+
+	config = nil
+	defer func() {
+		config = nil
+		if r := recover(); r == nil {
+			t.Errorf("The code did not panic")
+		}
+	}()
+	_ = New(strings.NewReader(input))
+}
+
+func TestParsePortRange(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected PortRange
+		ok       bool
+	}{
+		{"22", PortRange{22, 22}, true},
+		{"30000-30100", PortRange{30000, 30100}, true},
+		{"100-99", PortRange{}, false},
+		{"0", PortRange{}, false},
+		{"70000", PortRange{}, false},
+		{"ssh", PortRange{}, false},
+	}
+	for _, tc := range testCases {
+		port, err := ParsePortRange(tc.value)
+		if (err == nil) != tc.ok || port != tc.expected {
+			t.Errorf("ParsePortRange(%q) = %v, %v, expected %v", tc.value, port, err, tc.expected)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	valid := YAML_HEADER + fmt.Sprintf(SERVICE_CONFIG, 60) + fmt.Sprintf(VERIFICATION_CONFIG, "hs256", "", "secretstring")
+	testCases := []struct {
+		name  string
+		input string
+		err   bool
+	}{
+		{"valid", valid, false},
+		{"unsupported algo", YAML_HEADER + fmt.Sprintf(SERVICE_CONFIG, 60) + fmt.Sprintf(VERIFICATION_CONFIG, "notarealalgo", "", ""), true},
+		{"bad yaml", valid + "\n  service: [", true},
+		{"no services", YAML_HEADER + fmt.Sprintf(VERIFICATION_CONFIG, "hs256", "", "secretstring"), true},
+	}
+	for _, tc := range testCases {
+		result, err := Parse(strings.NewReader(tc.input))
+		if (err != nil) != tc.err {
+			t.Errorf("%s: Parse returned %v", tc.name, err)
+		}
+		if err == nil && result.Services[DEFAULT_SERVICE].Ttl != 60 {
+			t.Errorf("%s: unexpected config %v", tc.name, result)
+		}
+	}
+	if config != nil {
+		t.Errorf("Parse replaced the config returned by New")
+	}
+}
+
+func TestReload(t *testing.T) {
+	config = nil
+	defer func() { config = nil }()
+	original := New(strings.NewReader(YAML_HEADER + fmt.Sprintf(SERVICE_CONFIG, 60) + fmt.Sprintf(VERIFICATION_CONFIG, "hs256", "", "first")))
+	changed := YAML_HEADER + fmt.Sprintf(SERVICE_CONFIG, 120) + fmt.Sprintf(VERIFICATION_CONFIG, "hs256", "", "second")
+
+	apply := func(*AppConfig) error { return nil }
+	if _, err := Reload(strings.NewReader(YAML_HEADER+"  service: ["), apply); err == nil {
+		t.Errorf("an invalid config was reloaded")
+	}
+	missingKey := YAML_HEADER + fmt.Sprintf(SERVICE_CONFIG, 60) + fmt.Sprintf(VERIFICATION_CONFIG, "rs256", filepath.Join(t.TempDir(), "missing.pem"), "")
+	if _, err := Reload(strings.NewReader(missingKey), apply); err == nil {
+		t.Errorf("a config naming a missing key was reloaded")
+	}
+	if _, err := Reload(strings.NewReader(changed), func(*AppConfig) error { return fmt.Errorf("failed") }); err == nil {
+		t.Errorf("a config that failed to apply was reloaded")
+	}
+	if New(nil) != original {
+		t.Fatalf("a failed reload replaced the running config")
+	}
+
+	reloaded, err := Reload(strings.NewReader(changed), apply)
+	if err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	if New(nil) != reloaded || reloaded.Services[DEFAULT_SERVICE].Ttl != 120 {
+		t.Errorf("reloaded config was not kept")
+	}
+	// TTLs and per-service authorization rules apply without a restart
+	denied := reloaded.Services[DEFAULT_SERVICE]
+	denied.Authorization = AuthorizationConfig{Deny: []ClaimRule{{Claim: "sub", Equals: "mallory"}}}
+	reloaded.Services[DEFAULT_SERVICE] = denied
+	if changed := original.RestartRequired(reloaded); len(changed) != 0 {
+		t.Errorf("expected no restart for a TTL and authorization change, got %v", changed)
+	}
+
+	// The firewall keeps the started ports, but the new TTL and rules still apply
+	moved := denied
+	moved.Port = 2222
+	reloaded.Services = map[string]ServiceConfig{DEFAULT_SERVICE: moved, "added": moved}
+	if changed := original.RestartRequired(reloaded); !reflect.DeepEqual(changed, []string{"services"}) {
+		t.Errorf("expected a restart for services, got %v", changed)
+	}
+	services := original.StartedServices(reloaded)
+	if kept := services[DEFAULT_SERVICE]; len(services) != 1 || kept.Port != 1337 || kept.Ttl != 120 || !reflect.DeepEqual(kept.Authorization, denied.Authorization) {
+		t.Errorf("unexpected services %+v", services)
+	}
+
+	reloaded.Services = services
+	reloaded.Grpc.Listen = ":8443"
+	if changed := original.RestartRequired(reloaded); !reflect.DeepEqual(changed, []string{"grpc"}) {
+		t.Errorf("expected a restart for grpc, got %v", changed)
+	}
+}
@@ -0,0 +1,169 @@
+// Package envelope seals AuthRequest messages to the server's static X25519 key,
+// so tokens aren't exposed on the wire. Every request is sealed with a fresh
+// ephemeral key, from which the AEAD key is derived with HKDF.
+package envelope
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+
+	pb "github.com/micrictor/jpat/pkg/jpat"
+)
+
+// Bound into the derived key, so it can't be confused with keys for anything else
+const ENVELOPE_CONTEXT = "jpat envelope v1"
+
+var ErrInvalidEnvelope = errors.New("sealed request could not be opened")
+var ErrNotSealed = errors.New("request is not sealed")
+
+// PrivateKey is the server's envelope key, along with its public key
+type PrivateKey struct {
+	private []byte
+	public  []byte
+}
+
+// PublicKey is the key clients seal requests to
+type PublicKey []byte
+
+// IsSealed reports whether the request carries a sealed request
+func IsSealed(request *pb.AuthRequest) bool {
+	return len(request.EphemeralKey) > 0 || len(request.Sealed) > 0
+}
+
+// Seal encrypts request to the server key, returning the request to send
+func Seal(serverKey PublicKey, request *pb.AuthRequest) (*pb.AuthRequest, error) {
+	ephemeralPrivate := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand.Reader, ephemeralPrivate); err != nil {
+		return nil, err
+	}
+	ephemeralPublic, err := curve25519.X25519(ephemeralPrivate, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(ephemeralPrivate, serverKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server key: %v", err)
+	}
+	aead, err := newAead(shared, ephemeralPublic, serverKey)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := proto.Marshal(&pb.AuthRequest{
+		Token:     request.Token,
+		Service:   request.Service,
+		Timestamp: request.Timestamp,
+		Nonce:     request.Nonce,
+		Mac:       request.Mac,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The key is only ever used once, so a fixed nonce is safe
+	nonce := make([]byte, aead.NonceSize())
+	return &pb.AuthRequest{
+		EphemeralKey: ephemeralPublic,
+		Sealed:       aead.Seal(nil, nonce, plaintext, nil),
+	}, nil
+}
+
+// Open decrypts a sealed request with the server key
+func Open(key *PrivateKey, request *pb.AuthRequest) (*pb.AuthRequest, error) {
+	if !IsSealed(request) {
+		return nil, ErrNotSealed
+	}
+	shared, err := curve25519.X25519(key.private, request.EphemeralKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+	aead, err := newAead(shared, request.EphemeralKey, key.public)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	plaintext, err := aead.Open(nil, nonce, request.Sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+
+	var opened pb.AuthRequest
+	if err := proto.Unmarshal(plaintext, &opened); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+	if IsSealed(&opened) {
+		return nil, fmt.Errorf("%w: nested envelope", ErrInvalidEnvelope)
+	}
+	return &opened, nil
+}
+
+// Derive the AEAD key from the shared secret and both public keys
+func newAead(shared, ephemeralPublic, serverPublic []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, ephemeralPublic...), serverPublic...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(ENVELOPE_CONTEXT)), key); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
+
+// NewPrivateKey creates a private key from its 32 raw bytes
+func NewPrivateKey(private []byte) (*PrivateKey, error) {
+	if len(private) != curve25519.ScalarSize {
+		return nil, fmt.Errorf("envelope keys are %d bytes, got %d", curve25519.ScalarSize, len(private))
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &PrivateKey{private: private, public: public}, nil
+}
+
+// Public returns the key clients should seal requests to
+func (k *PrivateKey) Public() PublicKey {
+	return k.public
+}
+
+// LoadPrivateKey reads a base64 X25519 private key, as written by wg genkey
+func LoadPrivateKey(path string) (*PrivateKey, error) {
+	private, err := readKey(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewPrivateKey(private)
+}
+
+// LoadPublicKey reads a base64 X25519 public key, as written by wg pubkey
+func LoadPublicKey(path string) (PublicKey, error) {
+	public, err := readKey(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(public) != curve25519.PointSize {
+		return nil, fmt.Errorf("%s: envelope keys are %d bytes, got %d", path, curve25519.PointSize, len(public))
+	}
+	return public, nil
+}
+
+func readKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+	return key, nil
+}
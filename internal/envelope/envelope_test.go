@@ -0,0 +1,102 @@
+package envelope
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/micrictor/jpat/pkg/jpat"
+)
+
+func testKey(t *testing.T) *PrivateKey {
+	private := make([]byte, 32)
+	rand.Read(private)
+	key, err := NewPrivateKey(private)
+	if err != nil {
+		t.Fatalf("failed to create key: %v", err)
+	}
+	return key
+}
+
+func TestSealOpen(t *testing.T) {
+	key := testKey(t)
+	request := &pb.AuthRequest{Token: "header.payload.signature", Service: "ssh", Timestamp: 1700000000, Nonce: []byte("nonce"), Mac: []byte("mac")}
+
+	sealed, err := Seal(key.Public(), request)
+	if err != nil {
+		t.Fatalf("failed to seal: %v", err)
+	}
+	if !IsSealed(sealed) || sealed.Token != "" || sealed.Service != "" {
+		t.Fatalf("sealed request leaks its contents: %v", sealed)
+	}
+	opened, err := Open(key, sealed)
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	if opened.Token != request.Token || opened.Service != request.Service || opened.Timestamp != request.Timestamp ||
+		string(opened.Nonce) != string(request.Nonce) || string(opened.Mac) != string(request.Mac) {
+		t.Errorf("opened %v, expected %v", opened, request)
+	}
+
+	again, _ := Seal(key.Public(), request)
+	if string(again.EphemeralKey) == string(sealed.EphemeralKey) {
+		t.Errorf("ephemeral key was reused")
+	}
+}
+
+func TestOpenRejects(t *testing.T) {
+	key := testKey(t)
+	request := &pb.AuthRequest{Token: "header.payload.signature"}
+
+	testCases := []struct {
+		name   string
+		key    *PrivateKey
+		tamper func(*pb.AuthRequest)
+		err    error
+	}{
+		{"other key", testKey(t), func(*pb.AuthRequest) {}, ErrInvalidEnvelope},
+		{"ciphertext changed", key, func(r *pb.AuthRequest) { r.Sealed[0] ^= 1 }, ErrInvalidEnvelope},
+		{"ephemeral key changed", key, func(r *pb.AuthRequest) { r.EphemeralKey[0] ^= 1 }, ErrInvalidEnvelope},
+		{"low order ephemeral key", key, func(r *pb.AuthRequest) { r.EphemeralKey = make([]byte, 32) }, ErrInvalidEnvelope},
+		{"not sealed", key, func(r *pb.AuthRequest) { *r = pb.AuthRequest{Token: "x"} }, ErrNotSealed},
+	}
+	for _, tc := range testCases {
+		sealed, err := Seal(key.Public(), request)
+		if err != nil {
+			t.Fatalf("failed to seal: %v", err)
+		}
+		tc.tamper(sealed)
+		if _, err := Open(tc.key, sealed); !errors.Is(err, tc.err) {
+			t.Errorf("%s: Open returned %v, expected %v", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	key := testKey(t)
+	dir := t.TempDir()
+	privateFile, publicFile := filepath.Join(dir, "server.key"), filepath.Join(dir, "server.pub")
+	os.WriteFile(privateFile, []byte(base64.StdEncoding.EncodeToString(key.private)+"\n"), 0600)
+	os.WriteFile(publicFile, []byte(base64.StdEncoding.EncodeToString(key.public)+"\n"), 0600)
+
+	loadedPrivate, err := LoadPrivateKey(privateFile)
+	if err != nil {
+		t.Fatalf("failed to load private key: %v", err)
+	}
+	loadedPublic, err := LoadPublicKey(publicFile)
+	if err != nil {
+		t.Fatalf("failed to load public key: %v", err)
+	}
+	sealed, _ := Seal(loadedPublic, &pb.AuthRequest{Token: "x"})
+	if _, err := Open(loadedPrivate, sealed); err != nil {
+		t.Errorf("loaded keys do not match: %v", err)
+	}
+
+	os.WriteFile(publicFile, []byte(base64.StdEncoding.EncodeToString([]byte("short"))), 0600)
+	if _, err := LoadPublicKey(publicFile); err == nil {
+		t.Errorf("expected an error loading a short key")
+	}
+}
@@ -0,0 +1,149 @@
+// Package freshness stamps requests with a timestamp and nonce, so that a captured
+// packet can't be replayed once it falls outside the server's window, and can't be
+// replayed within the window either.
+package freshness
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/micrictor/jpat/pkg/jpat"
+)
+
+// Prefixed to the authenticated data, so the MAC can't be reused for anything else
+const FRESHNESS_CONTEXT = "jpat freshness v1"
+const NONCE_SIZE = 16
+
+var ErrMissingStamp = errors.New("request has no freshness stamp")
+var ErrInvalidMac = errors.New("request freshness mac is invalid")
+var ErrStale = errors.New("request timestamp is outside the freshness window")
+var ErrNonceReused = errors.New("request nonce has already been used")
+
+// Build the data the MAC covers: the hash of the token, the service, and the stamp
+func stampData(request *pb.AuthRequest) []byte {
+	tokenHash := sha256.Sum256([]byte(request.Token))
+	var data bytes.Buffer
+	data.WriteString(FRESHNESS_CONTEXT)
+	data.Write(tokenHash[:])
+	binary.Write(&data, binary.BigEndian, uint32(len(request.Service)))
+	data.WriteString(request.Service)
+	binary.Write(&data, binary.BigEndian, request.Timestamp)
+	data.Write(request.Nonce)
+	return data.Bytes()
+}
+
+func mac(key []byte, request *pb.AuthRequest) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(stampData(request))
+	return h.Sum(nil)
+}
+
+// Stamp sets the request's timestamp to now, picks a fresh nonce, and binds both
+// to the token and service with an HMAC.
+func Stamp(key []byte, request *pb.AuthRequest, now time.Time) error {
+	request.Timestamp = now.Unix()
+	request.Nonce = make([]byte, NONCE_SIZE)
+	if _, err := io.ReadFull(rand.Reader, request.Nonce); err != nil {
+		return err
+	}
+	request.Mac = mac(key, request)
+	return nil
+}
+
+// Checker verifies stamps, remembering every nonce until its timestamp leaves the
+// window.
+type Checker struct {
+	key    []byte
+	window time.Duration
+
+	mu        sync.Mutex
+	nonces    map[string]time.Time
+	lastSweep time.Time
+}
+
+// Create a checker accepting timestamps up to window away from the server's clock
+func New(key []byte, window time.Duration) *Checker {
+	return &Checker{
+		key:    key,
+		window: window,
+		nonces: make(map[string]time.Time),
+	}
+}
+
+// Rekey returns a checker using key and window that remembers c's nonces, so
+// requests seen before a reload can't be replayed after it
+func (c *Checker) Rekey(key []byte, window time.Duration) *Checker {
+	next := New(key, window)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for nonce, expiration := range c.nonces {
+		// Remember the nonce for as long as its timestamp is inside the new window
+		next.nonces[nonce] = expiration.Add(window - c.window)
+	}
+	next.lastSweep = c.lastSweep
+	return next
+}
+
+// Check the request's stamp at time now
+func (c *Checker) Check(request *pb.AuthRequest, now time.Time) error {
+	if request.Timestamp == 0 || len(request.Nonce) == 0 || len(request.Mac) == 0 {
+		return ErrMissingStamp
+	}
+	if !hmac.Equal(request.Mac, mac(c.key, request)) {
+		return ErrInvalidMac
+	}
+	timestamp := time.Unix(request.Timestamp, 0)
+	if skew := now.Sub(timestamp); skew > c.window || skew < -c.window {
+		return fmt.Errorf("%w: timestamp is %v away", ErrStale, skew)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.lastSweep) > c.window {
+		c.sweep(now)
+	}
+	nonce := string(request.Nonce)
+	if _, ok := c.nonces[nonce]; ok {
+		return ErrNonceReused
+	}
+	// Once its timestamp leaves the window, the request is rejected as stale
+	c.nonces[nonce] = timestamp.Add(c.window)
+	return nil
+}
+
+// Forget nonces whose requests would now be rejected as stale. Must hold mu.
+func (c *Checker) sweep(now time.Time) {
+	for nonce, expiration := range c.nonces {
+		if now.After(expiration) {
+			delete(c.nonces, nonce)
+		}
+	}
+	c.lastSweep = now
+}
+
+// LoadKey reads a base64 HMAC key, as written by openssl rand -base64 32
+func LoadKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+	if len(key) < 16 {
+		return nil, fmt.Errorf("%s: freshness keys must be at least 16 bytes", path)
+	}
+	return key, nil
+}
@@ -0,0 +1,99 @@
+package freshness
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	pb "github.com/micrictor/jpat/pkg/jpat"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func stamped(t *testing.T, at time.Time) *pb.AuthRequest {
+	request := &pb.AuthRequest{Token: "header.payload.signature", Service: "ssh"}
+	if err := Stamp(testKey, request, at); err != nil {
+		t.Fatalf("failed to stamp: %v", err)
+	}
+	return request
+}
+
+func TestCheck(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	testCases := []struct {
+		name   string
+		key    []byte
+		at     time.Time
+		tamper func(*pb.AuthRequest)
+		err    error
+	}{
+		{"fresh", testKey, now, func(*pb.AuthRequest) {}, nil},
+		{"edge of window", testKey, now.Add(-30 * time.Second), func(*pb.AuthRequest) {}, nil},
+		{"too old", testKey, now.Add(-31 * time.Second), func(*pb.AuthRequest) {}, ErrStale},
+		{"too new", testKey, now.Add(31 * time.Second), func(*pb.AuthRequest) {}, ErrStale},
+		{"other key", []byte("another key of sixteen bytes"), now, func(*pb.AuthRequest) {}, ErrInvalidMac},
+		{"timestamp changed", testKey, now, func(r *pb.AuthRequest) { r.Timestamp++ }, ErrInvalidMac},
+		{"token changed", testKey, now, func(r *pb.AuthRequest) { r.Token += "x" }, ErrInvalidMac},
+		{"service changed", testKey, now, func(r *pb.AuthRequest) { r.Service = "https" }, ErrInvalidMac},
+		{"unstamped", testKey, now, func(r *pb.AuthRequest) { r.Mac = nil }, ErrMissingStamp},
+	}
+	for _, tc := range testCases {
+		checker := New(tc.key, 30*time.Second)
+		request := stamped(t, tc.at)
+		tc.tamper(request)
+		if err := checker.Check(request, now); !errors.Is(err, tc.err) {
+			t.Errorf("%s: Check returned %v, expected %v", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestCheckNonceReuse(t *testing.T) {
+	checker := New(testKey, 30*time.Second)
+	now := time.Unix(1700000000, 0)
+	request := stamped(t, now)
+	if err := checker.Check(request, now); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := checker.Check(request, now.Add(time.Second)); err != ErrNonceReused {
+		t.Errorf("reused nonce returned %v", err)
+	}
+	if err := checker.Check(stamped(t, now), now); err != nil {
+		t.Errorf("fresh nonce returned %v", err)
+	}
+
+	// Once the request is stale its nonce is forgotten
+	later := now.Add(time.Minute)
+	checker.Check(stamped(t, later), later)
+	if len(checker.nonces) != 1 {
+		t.Errorf("expected stale nonces to be swept, have %d", len(checker.nonces))
+	}
+	if err := checker.Check(request, later); !errors.Is(err, ErrStale) {
+		t.Errorf("stale request returned %v", err)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	checker := New(testKey, 30*time.Second)
+	now := time.Unix(1700000000, 0)
+	request := stamped(t, now)
+	if err := checker.Check(request, now); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// A longer window keeps the nonce until the request leaves it
+	rekeyed := checker.Rekey(testKey, time.Minute)
+	later := now.Add(45 * time.Second)
+	if err := rekeyed.Check(request, later); err != ErrNonceReused {
+		t.Errorf("reused nonce returned %v after rekeying", err)
+	}
+	if expiration := rekeyed.nonces[string(request.Nonce)]; !expiration.Equal(now.Add(time.Minute)) {
+		t.Errorf("nonce expires at %v, expected %v", expiration, now.Add(time.Minute))
+	}
+
+	// Requests stamped with the old key are rejected once it is rotated
+	rotated := checker.Rekey([]byte("another key of sixteen bytes"), 30*time.Second)
+	if err := rotated.Check(stamped(t, now), now); !errors.Is(err, ErrInvalidMac) {
+		t.Errorf("old key returned %v after rotating", err)
+	}
+}
@@ -0,0 +1,299 @@
+package jwks
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const DEFAULT_REFRESH = time.Hour
+
+// Unknown kids trigger a refetch, so limit how often that can happen to keep
+// unauthenticated packets from hammering the identity provider.
+const DEFAULT_MIN_REFETCH = 10 * time.Second
+
+const MAX_DOCUMENT_SIZE = 1024 * 1024
+
+// JSON Web Key, as defined by RFC 7517. Only the fields needed to build
+// signature verification keys are decoded.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type document struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+type cachedKey struct {
+	alg string
+	key interface{}
+}
+
+// KeySet is a cached JWKS document loaded from a file or an HTTPS URL.
+type KeySet struct {
+	source string
+	client *http.Client
+
+	// Refresh is how long a fetched document is used before it is fetched again.
+	Refresh time.Duration
+	// MinRefetch is the minimum time between fetches caused by unknown kids.
+	MinRefetch time.Duration
+
+	mu sync.Mutex
+	// Replaced, never modified, by each fetch, so it can be read without the lock
+	keys    map[string]cachedKey
+	fetched time.Time
+	// Set while a fetch is in progress, so that callers join it
+	inflight *fetchCall
+}
+
+type fetchCall struct {
+	done chan struct{}
+	err  error
+}
+
+// Create a key set for the given source. Sources starting with https:// are
+// fetched using client; anything else is treated as a file path.
+func New(source string, refresh time.Duration, client *http.Client) (*KeySet, error) {
+	if strings.HasPrefix(strings.ToLower(source), "http://") {
+		return nil, fmt.Errorf("jwks url %s must use https", source)
+	}
+	if source == "" {
+		return nil, fmt.Errorf("jwks source is empty")
+	}
+	if refresh <= 0 {
+		refresh = DEFAULT_REFRESH
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &KeySet{
+		source:     source,
+		client:     client,
+		Refresh:    refresh,
+		MinRefetch: DEFAULT_MIN_REFETCH,
+	}, nil
+}
+
+// Keyfunc selects the verification key using the token header's kid.
+func (k *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok || kid == "" {
+		return nil, fmt.Errorf("token has no kid header")
+	}
+
+	keys, fetched, fetching := k.snapshot()
+	cached, ok := keys[kid]
+	if ok && !fetching && time.Since(fetched) > k.Refresh {
+		// Keep verifying with the cached keys while the document is refreshed
+		go func() {
+			if err := k.fetch(k.Refresh); err != nil {
+				log.Printf("failed to refresh jwks, using cached keys: %v", err)
+			}
+		}()
+	}
+	if !ok {
+		if err := k.fetch(k.MinRefetch); err != nil {
+			return nil, err
+		}
+		keys, _, _ = k.snapshot()
+		cached, ok = keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("no key with kid %s", kid)
+	}
+
+	if err := checkAlg(token.Method, cached); err != nil {
+		return nil, err
+	}
+	return cached.key, nil
+}
+
+// Ensure the token's signing method can be used with the key, so a token can't
+// pick a different algorithm than the key was issued for.
+func checkAlg(method jwt.SigningMethod, cached cachedKey) error {
+	if cached.alg != "" && cached.alg != method.Alg() {
+		return fmt.Errorf("token uses algo %s, key requires %s", method.Alg(), cached.alg)
+	}
+	var ok bool
+	switch method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		_, ok = cached.key.(*rsa.PublicKey)
+	case *jwt.SigningMethodECDSA:
+		_, ok = cached.key.(*ecdsa.PublicKey)
+	case *jwt.SigningMethodEd25519:
+		_, ok = cached.key.(ed25519.PublicKey)
+	}
+	if !ok {
+		return fmt.Errorf("token algo %s can't be used with the selected key", method.Alg())
+	}
+	return nil
+}
+
+func (k *KeySet) snapshot() (map[string]cachedKey, time.Time, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.keys, k.fetched, k.inflight != nil
+}
+
+// Load the document and replace the cached keys, unless it was fetched less than
+// minInterval ago. A fetch already in progress is joined instead. The lock isn't
+// held while fetching, so tokens with cached keys never wait for the identity
+// provider.
+func (k *KeySet) fetch(minInterval time.Duration) error {
+	k.mu.Lock()
+	if call := k.inflight; call != nil {
+		k.mu.Unlock()
+		<-call.done
+		return call.err
+	}
+	if time.Since(k.fetched) < minInterval {
+		k.mu.Unlock()
+		return nil
+	}
+	call := &fetchCall{done: make(chan struct{})}
+	k.inflight = call
+	// Set this even on failure, so failures are also rate limited
+	k.fetched = time.Now()
+	k.mu.Unlock()
+
+	keys, err := k.load()
+	k.mu.Lock()
+	if err == nil {
+		k.keys = keys
+	}
+	k.inflight = nil
+	call.err = err
+	k.mu.Unlock()
+	close(call.done)
+	return err
+}
+
+// Read and parse the document
+func (k *KeySet) load() (map[string]cachedKey, error) {
+	data, err := k.read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load jwks from %s: %v", k.source, err)
+	}
+
+	var doc document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse jwks from %s: %v", k.source, err)
+	}
+
+	keys := make(map[string]cachedKey)
+	for _, jwk := range doc.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Printf("skipping jwk %s: %v", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = cachedKey{alg: jwk.Alg, key: key}
+	}
+	return keys, nil
+}
+
+func (k *KeySet) read() ([]byte, error) {
+	if !strings.HasPrefix(strings.ToLower(k.source), "https://") {
+		return os.ReadFile(k.source)
+	}
+
+	resp, err := k.client.Get(k.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, MAX_DOCUMENT_SIZE))
+}
+
+func (j jsonWebKey) publicKey() (interface{}, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeInt(j.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid n: %v", err)
+		}
+		e, err := decodeInt(j.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid e: %v", err)
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid e")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", j.Crv)
+		}
+		x, err := decodeInt(j.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x: %v", err)
+		}
+		y, err := decodeInt(j.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y: %v", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", j.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if j.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", j.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid x")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", j.Kty)
+	}
+}
+
+func decodeInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty value")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
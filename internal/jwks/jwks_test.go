@@ -0,0 +1,256 @@
+package jwks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+type testServer struct {
+	mu       sync.Mutex
+	document document
+	hits     int
+	// If set, responses wait until it is closed
+	stall chan struct{}
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.hits++
+	stall, doc := s.stall, s.document
+	s.mu.Unlock()
+	if stall != nil {
+		<-stall
+	}
+	json.NewEncoder(w).Encode(doc)
+}
+
+func (s *testServer) setKeys(keys ...jsonWebKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.document = document{Keys: keys}
+}
+
+func (s *testServer) fetches() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits
+}
+
+func rsaJwk(t *testing.T, kid string) (*rsa.PrivateKey, jsonWebKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate rsa key: %v", err)
+	}
+	return key, jsonWebKey{
+		Kty: "RSA",
+		Kid: kid,
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJwk(t *testing.T, kid string) (*ecdsa.PrivateKey, jsonWebKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ec key: %v", err)
+	}
+	return key, jsonWebKey{
+		Kty: "EC",
+		Kid: kid,
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+	}
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{}) string {
+	token := jwt.NewWithClaims(method, jwt.MapClaims{"exp": time.Now().Add(time.Minute).Unix()})
+	token.Header["kid"] = kid
+	out, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return out
+}
+
+func newTestKeySet(t *testing.T, server *testServer) *KeySet {
+	httpServer := httptest.NewTLSServer(server)
+	t.Cleanup(httpServer.Close)
+
+	keySet, err := New(httpServer.URL, time.Hour, httpServer.Client())
+	if err != nil {
+		t.Fatalf("failed to create key set: %v", err)
+	}
+	return keySet
+}
+
+func TestKeyfuncSelectsByKid(t *testing.T) {
+	rsaKey, rsaPublic := rsaJwk(t, "rsa-1")
+	ecKey, ecPublic := ecJwk(t, "ec-1")
+	server := &testServer{}
+	server.setKeys(rsaPublic, ecPublic)
+	keySet := newTestKeySet(t, server)
+
+	testCases := []struct {
+		token string
+		valid bool
+	}{
+		{sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey), true},
+		{sign(t, jwt.SigningMethodES256, "ec-1", ecKey), true},
+		// Right key, wrong kid
+		{sign(t, jwt.SigningMethodRS256, "ec-1", rsaKey), false},
+		{sign(t, jwt.SigningMethodES256, "rsa-1", ecKey), false},
+		// HMAC using the public key as the secret
+		{sign(t, jwt.SigningMethodHS256, "rsa-1", []byte(rsaPublic.N)), false},
+		{sign(t, jwt.SigningMethodRS256, "", rsaKey), false},
+	}
+	for i, tc := range testCases {
+		_, err := jwt.Parse(tc.token, keySet.Keyfunc)
+		if tc.valid && err != nil {
+			t.Errorf("case %d: unexpected error %v", i, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("case %d: expected token to be rejected", i)
+		}
+	}
+	if server.fetches() != 1 {
+		t.Errorf("expected 1 fetch, got %d", server.fetches())
+	}
+}
+
+func TestKeyfuncChecksJwkAlg(t *testing.T) {
+	key, public := rsaJwk(t, "key")
+	public.Alg = "RS256"
+	server := &testServer{}
+	server.setKeys(public)
+	keySet := newTestKeySet(t, server)
+
+	if _, err := jwt.Parse(sign(t, jwt.SigningMethodRS256, "key", key), keySet.Keyfunc); err != nil {
+		t.Errorf("token matching the key's alg rejected: %v", err)
+	}
+	for _, method := range []jwt.SigningMethod{jwt.SigningMethodRS512, jwt.SigningMethodPS256} {
+		if _, err := jwt.Parse(sign(t, method, "key", key), keySet.Keyfunc); err == nil {
+			t.Errorf("%s token accepted by an RS256 key", method.Alg())
+		}
+	}
+}
+
+func TestKeyfuncRefetchesUnknownKid(t *testing.T) {
+	oldKey, oldPublic := rsaJwk(t, "old")
+	newKey, newPublic := rsaJwk(t, "new")
+	server := &testServer{}
+	server.setKeys(oldPublic)
+	keySet := newTestKeySet(t, server)
+	keySet.MinRefetch = 0
+
+	if _, err := jwt.Parse(sign(t, jwt.SigningMethodRS256, "old", oldKey), keySet.Keyfunc); err != nil {
+		t.Fatalf("old key rejected: %v", err)
+	}
+
+	server.setKeys(newPublic)
+	if _, err := jwt.Parse(sign(t, jwt.SigningMethodRS256, "new", newKey), keySet.Keyfunc); err != nil {
+		t.Errorf("rotated key rejected: %v", err)
+	}
+	if server.fetches() != 2 {
+		t.Errorf("expected 2 fetches, got %d", server.fetches())
+	}
+
+	// Unknown kids only trigger a single refetch each
+	if _, err := jwt.Parse(sign(t, jwt.SigningMethodRS256, "missing", newKey), keySet.Keyfunc); err == nil {
+		t.Errorf("unknown kid accepted")
+	}
+	if server.fetches() != 3 {
+		t.Errorf("expected 3 fetches, got %d", server.fetches())
+	}
+}
+
+func TestKeyfuncRateLimitsRefetch(t *testing.T) {
+	key, public := rsaJwk(t, "key")
+	server := &testServer{}
+	server.setKeys(public)
+	keySet := newTestKeySet(t, server)
+
+	for i := 0; i < 5; i++ {
+		jwt.Parse(sign(t, jwt.SigningMethodRS256, "missing", key), keySet.Keyfunc)
+	}
+	if server.fetches() != 1 {
+		t.Errorf("expected 1 fetch, got %d", server.fetches())
+	}
+}
+
+func TestKeyfuncDoesNotWaitForRefresh(t *testing.T) {
+	key, public := rsaJwk(t, "key")
+	server := &testServer{}
+	server.setKeys(public)
+	keySet := newTestKeySet(t, server)
+	token := sign(t, jwt.SigningMethodRS256, "key", key)
+	if _, err := jwt.Parse(token, keySet.Keyfunc); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// The identity provider stalls while the document is refreshed
+	stall := make(chan struct{})
+	server.mu.Lock()
+	server.stall = stall
+	server.mu.Unlock()
+	keySet.Refresh = 0
+	done := make(chan error)
+	go func() {
+		_, err := jwt.Parse(token, keySet.Keyfunc)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("verification waited for the refresh")
+	}
+
+	close(stall)
+	deadline := time.Now().Add(time.Second)
+	for server.fetches() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if server.fetches() != 2 {
+		t.Errorf("expected the document to be refreshed, got %d fetches", server.fetches())
+	}
+}
+
+func TestKeyfuncFromFile(t *testing.T) {
+	key, public := ecJwk(t, "file-key")
+	data, _ := json.Marshal(document{Keys: []jsonWebKey{public}})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("failed to write jwks: %v", err)
+	}
+
+	keySet, err := New(path, 0, nil)
+	if err != nil {
+		t.Fatalf("failed to create key set: %v", err)
+	}
+	if _, err := jwt.Parse(sign(t, jwt.SigningMethodES256, "file-key", key), keySet.Keyfunc); err != nil {
+		t.Errorf("file key rejected: %v", err)
+	}
+}
+
+func TestNewRejectsPlainHttp(t *testing.T) {
+	if _, err := New("http://idp.example.com/jwks", 0, nil); err == nil {
+		t.Errorf("expected http url to be rejected")
+	}
+}
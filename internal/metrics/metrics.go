@@ -0,0 +1,76 @@
+// Package metrics exposes the server's Prometheus metrics
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	PacketsReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "jpat_packets_received_total",
+		Help: "UDP packets received.",
+	})
+	PacketsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "jpat_packets_dropped_total",
+		Help: "UDP packets dropped because the request queue was full.",
+	})
+	ParseFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "jpat_parse_failures_total",
+		Help: "Packets that could not be parsed as a request.",
+	})
+	Rejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "jpat_rejections_total",
+		Help: "Rejected requests, by reply status.",
+	}, []string{"reason"})
+	Authorizations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "jpat_authorizations_total",
+		Help: "Authorized requests, by service and token subject.",
+	}, []string{"service", "subject"})
+	VerificationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "jpat_verification_seconds",
+		Help:    "Time taken to verify a token.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 12),
+	})
+	FirewallApplySeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "jpat_firewall_apply_seconds",
+		Help: "Time taken to apply a term to the firewall.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(PacketsReceived, PacketsDropped, ParseFailures, Rejections,
+		Authorizations, VerificationSeconds, FirewallApplySeconds)
+}
+
+// WatchTerms exposes gauges for the active terms. terms returns the number of
+// active terms, and the unix time the next one expires at.
+func WatchTerms(terms func() (int, int64)) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "jpat_active_terms",
+		Help: "Terms currently open in the firewall.",
+	}, func() float64 {
+		count, _ := terms()
+		return float64(count)
+	}))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "jpat_next_expiry_seconds",
+		Help: "Seconds until the next term expires, or 0 if none are active.",
+	}, func() float64 {
+		count, next := terms()
+		if count == 0 {
+			return 0
+		}
+		return time.Until(time.Unix(next, 0)).Seconds()
+	}))
+}
+
+// Serve the metrics on /metrics at listen
+func Serve(listen string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return http.ListenAndServe(listen, mux)
+}
@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func gauge(t *testing.T, name string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() == name {
+			return family.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	t.Fatalf("no metric named %s", name)
+	return 0
+}
+
+func TestWatchTerms(t *testing.T) {
+	count, next := 0, int64(0)
+	WatchTerms(func() (int, int64) { return count, next })
+
+	if active, expiry := gauge(t, "jpat_active_terms"), gauge(t, "jpat_next_expiry_seconds"); active != 0 || expiry != 0 {
+		t.Errorf("no terms gave %v active, next expiry %v", active, expiry)
+	}
+	count, next = 2, time.Now().Add(time.Minute).Unix()
+	if active := gauge(t, "jpat_active_terms"); active != 2 {
+		t.Errorf("expected 2 active terms, got %v", active)
+	}
+	if expiry := gauge(t, "jpat_next_expiry_seconds"); expiry < 55 || expiry > 60 {
+		t.Errorf("expected the next expiry in about 60s, got %v", expiry)
+	}
+}
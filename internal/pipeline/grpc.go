@@ -0,0 +1,123 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/micrictor/jpat/internal/config"
+	pb "github.com/micrictor/jpat/pkg/jpat"
+)
+
+// Transport names used in the audit log
+const TRANSPORT_UDP = "udp"
+const TRANSPORT_GRPC = "grpc"
+
+// jpatService serves the Jpat gRPC service using the pipeline
+type jpatService struct {
+	pb.UnimplementedJpatServer
+	pipeline *Current
+}
+
+// NewGrpcServer creates a TLS gRPC server serving the Jpat service with the
+// current pipeline.
+func NewGrpcServer(pipeline *Current, grpcConfig config.GrpcConfig) (*grpc.Server, error) {
+	tlsConfig, err := serverTLSConfig(grpcConfig)
+	if err != nil {
+		return nil, err
+	}
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)))
+	pb.RegisterJpatServer(server, &jpatService{pipeline: pipeline})
+	return server, nil
+}
+
+func serverTLSConfig(grpcConfig config.GrpcConfig) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(grpcConfig.CertFile, grpcConfig.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load grpc certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if grpcConfig.ClientCAFile != "" {
+		pemData, err := os.ReadFile(grpcConfig.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read grpc client CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificates found in %s", grpcConfig.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+func (s *jpatService) RequestAuthorization(ctx context.Context, request *pb.AuthRequest) (*pb.AuthReply, error) {
+	client, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Internal, "failed to get the client address")
+	}
+	tcpAddr, ok := client.Addr.(*net.TCPAddr)
+	if !ok {
+		return nil, status.Errorf(codes.Internal, "unsupported client address %v", client.Addr)
+	}
+
+	p := s.pipeline.Load()
+	request, reply, err := authorize(p, tcpAddr.IP, request)
+	p.Record(TRANSPORT_GRPC, tcpAddr.IP, request, reply, err)
+	if err != nil {
+		return nil, statusError(err, p.Config.ErrorReplies.HideDetails)
+	}
+	p.Sign(request, reply)
+	return reply, nil
+}
+
+// Run the request through the pipeline, returning the opened request
+func authorize(p *Pipeline, source net.IP, request *pb.AuthRequest) (*pb.AuthRequest, *pb.AuthReply, error) {
+	if err := p.Admit(source); err != nil {
+		return request, nil, err
+	}
+	request, err := p.Open(request)
+	if err != nil {
+		return request, nil, err
+	}
+	reply, err := p.Authorize(source, request)
+	return request, reply, err
+}
+
+// Convert a pipeline error into a gRPC status
+func statusError(err error, hideDetails bool) error {
+	reply := ErrorReply(err, hideDetails)
+	message := reply.Message
+	if message == "" {
+		message = reply.Status.String()
+	}
+	switch reply.Status {
+	case pb.Status_UNKNOWN_SERVICE:
+		return status.Error(codes.NotFound, message)
+	case pb.Status_POLICY_DENIED, pb.Status_REPLAY, pb.Status_DENIED:
+		return status.Error(codes.PermissionDenied, message)
+	case pb.Status_INVALID_SIGNATURE, pb.Status_EXPIRED, pb.Status_INVALID_CLAIMS, pb.Status_STALE_REQUEST:
+		return status.Error(codes.Unauthenticated, message)
+	case pb.Status_RATE_LIMITED:
+		return status.Error(codes.ResourceExhausted, message)
+	case pb.Status_INVALID_ENVELOPE:
+		return status.Error(codes.InvalidArgument, message)
+	case pb.Status_UNSUPPORTED_ADDRESS_FAMILY:
+		return status.Error(codes.FailedPrecondition, message)
+	default:
+		return status.Error(codes.Internal, message)
+	}
+}
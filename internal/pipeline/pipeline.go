@@ -0,0 +1,295 @@
+package pipeline
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+
+	"github.com/micrictor/jpat/internal/audit"
+	"github.com/micrictor/jpat/internal/config"
+	"github.com/micrictor/jpat/internal/envelope"
+	"github.com/micrictor/jpat/internal/freshness"
+	"github.com/micrictor/jpat/internal/metrics"
+	"github.com/micrictor/jpat/internal/policy"
+	"github.com/micrictor/jpat/internal/ratelimit"
+	"github.com/micrictor/jpat/internal/replay"
+	"github.com/micrictor/jpat/internal/rules"
+	"github.com/micrictor/jpat/internal/signing"
+	"github.com/micrictor/jpat/internal/token"
+	pb "github.com/micrictor/jpat/pkg/jpat"
+)
+
+// Pipeline verifies authorization requests and opens the firewall for them. It is
+// shared by every listener, so requests get the same checks whatever the transport.
+type Pipeline struct {
+	Config *config.AppConfig
+	Engine *rules.RulesEngine
+	// Only set when replay protection is enabled in the config
+	Replay *replay.Cache
+	// If set, replies are signed with this key
+	SigningKey ed25519.PrivateKey
+	// If set, clients may seal their requests to this key
+	EnvelopeKey *envelope.PrivateKey
+	// If set, every request must carry a fresh stamp
+	Freshness *freshness.Checker
+	// Only set when the matching limit is enabled in the config
+	SourceLimit  *ratelimit.Limiter
+	SubjectLimit *ratelimit.Limiter
+	// Records every decision. Nil discards them.
+	Audit *audit.Logger
+}
+
+func New(appConfig *config.AppConfig, engine *rules.RulesEngine, replayGuard *replay.Cache) *Pipeline {
+	p := &Pipeline{
+		Config: appConfig,
+		Engine: engine,
+		Replay: replayGuard,
+	}
+	if limit := appConfig.RateLimits.PerSource; limit.Rate > 0 {
+		p.SourceLimit = ratelimit.New(limit.Rate, limit.Burst)
+	}
+	if limit := appConfig.RateLimits.PerSubject; limit.Rate > 0 {
+		p.SubjectLimit = ratelimit.New(limit.Rate, limit.Burst)
+	}
+	return p
+}
+
+// LoadKeys loads the signing, envelope and freshness keys named by the config. An
+// existing freshness checker is rekeyed, keeping the nonces it has seen.
+func (p *Pipeline) LoadKeys() error {
+	var err error
+	p.SigningKey, p.EnvelopeKey = nil, nil
+	if p.Config.Signing.PrivateKeyFile != "" {
+		if p.SigningKey, err = signing.LoadPrivateKey(p.Config.Signing.PrivateKeyFile); err != nil {
+			return fmt.Errorf("failed to load signing key: %v", err)
+		}
+	}
+	if p.Config.Envelope.PrivateKeyFile != "" {
+		if p.EnvelopeKey, err = envelope.LoadPrivateKey(p.Config.Envelope.PrivateKeyFile); err != nil {
+			return fmt.Errorf("failed to load envelope key: %v", err)
+		}
+	}
+	if p.Config.Freshness.KeyFile == "" {
+		p.Freshness = nil
+		return nil
+	}
+	key, err := freshness.LoadKey(p.Config.Freshness.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load freshness key: %v", err)
+	}
+	window := p.Config.Freshness.Window
+	if window == 0 {
+		window = config.DEFAULT_FRESHNESS_WINDOW
+	}
+	if p.Freshness != nil {
+		p.Freshness = p.Freshness.Rekey(key, time.Duration(window))
+	} else {
+		p.Freshness = freshness.New(key, time.Duration(window))
+	}
+	return nil
+}
+
+// Admit checks the per-source rate limit. Transports call it first, before doing
+// any work for the request.
+func (p *Pipeline) Admit(source net.IP) error {
+	if p.SourceLimit != nil && !p.SourceLimit.Allow(source.String(), time.Now()) {
+		return fmt.Errorf("source %v: %w", source, ratelimit.ErrRateLimited)
+	}
+	return nil
+}
+
+// Open returns the request sealed inside request, or request itself if it isn't
+// sealed. On error the request is returned unchanged, so that the error reply can
+// still be signed.
+func (p *Pipeline) Open(request *pb.AuthRequest) (*pb.AuthRequest, error) {
+	if !envelope.IsSealed(request) {
+		if p.Config.Envelope.Required {
+			return request, envelope.ErrNotSealed
+		}
+		return request, nil
+	}
+	if p.EnvelopeKey == nil {
+		return request, fmt.Errorf("%w: the server has no envelope key", envelope.ErrInvalidEnvelope)
+	}
+	opened, err := envelope.Open(p.EnvelopeKey, request)
+	if err != nil {
+		return request, err
+	}
+	return opened, nil
+}
+
+// Authorize verifies the request sent from source, and adds a term opening the
+// requested service. The reply names the socket the client may now connect to.
+func (p *Pipeline) Authorize(source net.IP, request *pb.AuthRequest) (*pb.AuthReply, error) {
+	service, err := p.Config.Service(request.Service)
+	if err != nil {
+		return nil, err
+	}
+
+	// Checking the stamp is cheap, so stale packets never reach signature verification
+	if p.Freshness != nil {
+		if err := p.Freshness.Check(request, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.SubjectLimit != nil {
+		subject, _ := unverifiedClaims(request.Token)["sub"].(string)
+		if subject != "" && !p.SubjectLimit.Allow(subject, time.Now()) {
+			return nil, fmt.Errorf("subject %s: %w", subject, ratelimit.ErrRateLimited)
+		}
+	}
+
+	start := time.Now()
+	inputToken, err := token.ProcessToken(request.Token, p.Config)
+	metrics.VerificationSeconds.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	term, err := p.Engine.NewTerm(source, inputToken, service, p.Config)
+	if err != nil {
+		return nil, err
+	}
+	// Only record the jti once the token passed the policy and source checks, so a
+	// sniffed token sent from elsewhere can't use it up
+	if p.Replay != nil {
+		if err := p.Replay.CheckToken(inputToken, source); err != nil {
+			return nil, err
+		}
+	}
+	p.Engine.ApplyTerm(term)
+	expiration := term.Expiration
+
+	subject := ""
+	if claims, ok := inputToken.Claims.(jwt.MapClaims); ok {
+		subject, _ = claims["sub"].(string)
+	}
+	metrics.Authorizations.WithLabelValues(service.Name, subject).Inc()
+
+	// NewTerm already checked that the service has an address in the client's
+	// family. A service with several ports is named by its first one.
+	serviceAddr, _ := service.AddressFor(source)
+	return &pb.AuthReply{
+		Socket:     net.JoinHostPort(serviceAddr.String(), strconv.Itoa(int(service.PortRanges()[0].From))),
+		Expiration: expiration,
+	}, nil
+}
+
+// Read the claims without verifying the token, such as to check the subject's rate
+// limit before paying for signature verification. Returns no claims if the token
+// can't be parsed.
+func unverifiedClaims(tokenString string) jwt.MapClaims {
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(tokenString, claims); err != nil {
+		return jwt.MapClaims{}
+	}
+	return claims
+}
+
+// Record the decision on a request in the metrics and the audit log. err is the
+// error the request was rejected with, or nil if it was authorized.
+func (p *Pipeline) Record(transport string, source net.IP, request *pb.AuthRequest, reply *pb.AuthReply, err error) {
+	if err != nil {
+		Reject(err)
+	}
+	if p.Audit == nil {
+		return
+	}
+
+	claims := unverifiedClaims(request.Token)
+	record := audit.Record{
+		Event:       audit.EVENT_DECISION,
+		Transport:   transport,
+		Source:      source.String(),
+		Fingerprint: audit.Fingerprint(request.Token),
+		Service:     request.Service,
+	}
+	record.Subject, _ = claims["sub"].(string)
+	record.Issuer, _ = claims["iss"].(string)
+	record.Jti, _ = claims["jti"].(string)
+	if service, serviceErr := p.Config.Service(request.Service); serviceErr == nil {
+		record.Service = service.Name
+	}
+	if err != nil {
+		record.Decision = audit.DECISION_REJECTED
+		record.Reason = StatusOf(err).String()
+		record.Detail = err.Error()
+	} else {
+		record.Decision = audit.DECISION_AUTHORIZED
+		record.Reason = pb.Status_OK.String()
+		record.Expiration = reply.Expiration
+	}
+	p.Audit.Log(record)
+}
+
+// Sign the reply to the request, if the pipeline has a signing key
+func (p *Pipeline) Sign(request *pb.AuthRequest, reply *pb.AuthReply) {
+	if p.SigningKey != nil {
+		signing.SignReply(p.SigningKey, request.Token, reply)
+	}
+}
+
+// StatusOf classifies an error returned by Authorize
+func StatusOf(err error) pb.Status {
+	var unknownService *config.UnknownServiceError
+	var denied *policy.DeniedError
+	var validation *jwt.ValidationError
+	var claim *token.ClaimError
+	switch {
+	case err == nil:
+		return pb.Status_OK
+	case errors.As(err, &unknownService):
+		return pb.Status_UNKNOWN_SERVICE
+	case errors.As(err, &denied):
+		return pb.Status_POLICY_DENIED
+	case errors.Is(err, replay.ErrReplayed), errors.Is(err, replay.ErrMissingJti), errors.Is(err, freshness.ErrNonceReused):
+		return pb.Status_REPLAY
+	case errors.As(err, &claim):
+		if claim.Claim == "exp" {
+			return pb.Status_EXPIRED
+		}
+		return pb.Status_INVALID_CLAIMS
+	case errors.Is(err, ratelimit.ErrRateLimited):
+		return pb.Status_RATE_LIMITED
+	case errors.Is(err, freshness.ErrStale):
+		return pb.Status_STALE_REQUEST
+	case errors.Is(err, freshness.ErrMissingStamp), errors.Is(err, freshness.ErrInvalidMac):
+		return pb.Status_INVALID_SIGNATURE
+	case errors.As(err, &validation):
+		return pb.Status_INVALID_SIGNATURE
+	case errors.Is(err, rules.ErrTermExpired):
+		return pb.Status_EXPIRED
+	case errors.Is(err, rules.ErrAddressFamily):
+		return pb.Status_UNSUPPORTED_ADDRESS_FAMILY
+	case errors.Is(err, envelope.ErrInvalidEnvelope), errors.Is(err, envelope.ErrNotSealed):
+		return pb.Status_INVALID_ENVELOPE
+	default:
+		return pb.Status_INTERNAL_ERROR
+	}
+}
+
+// Reject counts the rejection of a request, by the status it is rejected with
+func Reject(err error) {
+	metrics.Rejections.WithLabelValues(StatusOf(err).String()).Inc()
+}
+
+// ErrorReply builds the reply telling the client why its request was rejected.
+// With hideDetails, the client is only told that it was denied.
+func ErrorReply(err error, hideDetails bool) *pb.AuthReply {
+	if hideDetails {
+		return &pb.AuthReply{Status: pb.Status_DENIED}
+	}
+	status := StatusOf(err)
+	message := err.Error()
+	// Internal errors can leak details of the host, such as file paths
+	if status == pb.Status_INTERNAL_ERROR {
+		message = "internal error"
+	}
+	return &pb.AuthReply{Status: status, Message: message}
+}
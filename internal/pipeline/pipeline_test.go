@@ -0,0 +1,497 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	"github.com/micrictor/jpat/internal/audit"
+	"github.com/micrictor/jpat/internal/config"
+	"github.com/micrictor/jpat/internal/envelope"
+	"github.com/micrictor/jpat/internal/freshness"
+	"github.com/micrictor/jpat/internal/metrics"
+	"github.com/micrictor/jpat/internal/policy"
+	"github.com/micrictor/jpat/internal/replay"
+	"github.com/micrictor/jpat/internal/rules"
+	"github.com/micrictor/jpat/internal/signing"
+	"github.com/micrictor/jpat/internal/token"
+	pb "github.com/micrictor/jpat/pkg/jpat"
+)
+
+var testSecret = []byte("secretstring")
+
+var jtiCounter int
+
+func testConfig() *config.AppConfig {
+	return &config.AppConfig{
+		Services: map[string]config.ServiceConfig{
+			"ssh": {Name: "ssh", Host: "127.0.0.1", Hosts: []string{"::1"}, Port: 22, Protocol: "tcp", Ttl: 60},
+		},
+		Verification: config.VerificationConfig{SourceClaim: config.DEFAULT_SOURCE_CLAIM},
+		Keyfunc: func(*jwt.Token) (interface{}, error) {
+			return testSecret, nil
+		},
+	}
+}
+
+func testToken(t *testing.T, claims jwt.MapClaims) string {
+	if _, ok := claims["exp"]; !ok {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+	}
+	if _, ok := claims["jti"]; !ok {
+		jtiCounter++
+		claims["jti"] = fmt.Sprintf("generated-%d", jtiCounter)
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(testSecret)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return signed
+}
+
+func newTestPipeline(t *testing.T) *Pipeline {
+	engine, err := rules.New(rules.NewMemoryBackend(), config.FirewallConfig{})
+	if err != nil {
+		t.Fatalf("failed to create engine: %v", err)
+	}
+	t.Cleanup(engine.Close)
+	return New(testConfig(), engine, replay.New(0, false))
+}
+
+func TestAuthorize(t *testing.T) {
+	p := newTestPipeline(t)
+
+	testCases := []struct {
+		source string
+		socket string
+	}{
+		{"192.0.2.1", "127.0.0.1:22"},
+		{"2001:db8::1", "[::1]:22"},
+	}
+	for _, tc := range testCases {
+		reply, err := p.Authorize(net.ParseIP(tc.source), &pb.AuthRequest{Token: testToken(t, jwt.MapClaims{}), Service: "ssh"})
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tc.source, err)
+		}
+		if reply.Socket != tc.socket || reply.Expiration == 0 {
+			t.Errorf("%s: unexpected reply %v", tc.source, reply)
+		}
+	}
+}
+
+func TestReplayRecordedAfterPolicy(t *testing.T) {
+	p := newTestPipeline(t)
+	request := &pb.AuthRequest{Token: testToken(t, jwt.MapClaims{config.DEFAULT_SOURCE_CLAIM: "198.51.100.0/24"}), Service: "ssh"}
+
+	// A sniffed token sent from outside its networks doesn't use up the jti
+	if _, err := p.Authorize(net.ParseIP("192.0.2.1"), request); err == nil || StatusOf(err) == pb.Status_REPLAY {
+		t.Fatalf("token from a disallowed source returned %v", err)
+	}
+	if _, err := p.Authorize(net.ParseIP("198.51.100.7"), request); err != nil {
+		t.Errorf("token holder was locked out: %v", err)
+	}
+	if _, err := p.Authorize(net.ParseIP("198.51.100.7"), request); StatusOf(err) != pb.Status_REPLAY {
+		t.Errorf("replayed token returned %v", err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	p := newTestPipeline(t)
+	private := make([]byte, 32)
+	rand.Read(private)
+	key, _ := envelope.NewPrivateKey(private)
+	request := &pb.AuthRequest{Token: testToken(t, jwt.MapClaims{}), Service: "ssh"}
+	sealed, _ := envelope.Seal(key.Public(), request)
+
+	if _, err := p.Open(sealed); StatusOf(err) != pb.Status_INVALID_ENVELOPE {
+		t.Errorf("opened a sealed request without a key: %v", err)
+	}
+	p.EnvelopeKey = key
+	opened, err := p.Open(sealed)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := p.Authorize(net.ParseIP("192.0.2.1"), opened); err != nil {
+		t.Errorf("failed to authorize the opened request: %v", err)
+	}
+
+	// Plaintext requests are only accepted until sealing is required
+	plain := &pb.AuthRequest{Token: testToken(t, jwt.MapClaims{})}
+	if opened, err := p.Open(plain); err != nil || opened != plain {
+		t.Errorf("plaintext request rejected: %v", err)
+	}
+	p.Config.Envelope.Required = true
+	if _, err := p.Open(plain); StatusOf(err) != pb.Status_INVALID_ENVELOPE {
+		t.Errorf("plaintext request accepted when sealing is required: %v", err)
+	}
+}
+
+func TestFreshness(t *testing.T) {
+	p := newTestPipeline(t)
+	key := []byte("0123456789abcdef")
+	p.Freshness = freshness.New(key, 30*time.Second)
+	source := net.ParseIP("192.0.2.1")
+
+	request := &pb.AuthRequest{Token: testToken(t, jwt.MapClaims{})}
+	if _, err := p.Authorize(source, request); StatusOf(err) != pb.Status_INVALID_SIGNATURE {
+		t.Errorf("unstamped request returned %v", err)
+	}
+	freshness.Stamp(key, request, time.Now())
+	if _, err := p.Authorize(source, request); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	stale := &pb.AuthRequest{Token: testToken(t, jwt.MapClaims{})}
+	freshness.Stamp(key, stale, time.Now().Add(-time.Minute))
+	if _, err := p.Authorize(source, stale); StatusOf(err) != pb.Status_STALE_REQUEST {
+		t.Errorf("stale request returned %v", err)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	appConfig := testConfig()
+	appConfig.RateLimits = config.RateLimitsConfig{
+		PerSource:  config.RateLimitConfig{Rate: 1, Burst: 2},
+		PerSubject: config.RateLimitConfig{Rate: 1, Burst: 1},
+	}
+	engine, _ := rules.New(rules.NewMemoryBackend(), config.FirewallConfig{})
+	t.Cleanup(engine.Close)
+	p := New(appConfig, engine, nil)
+
+	source := net.ParseIP("192.0.2.1")
+	for i := 0; i < 2; i++ {
+		if err := p.Admit(source); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if err := p.Admit(source); StatusOf(err) != pb.Status_RATE_LIMITED {
+		t.Errorf("source over its limit returned %v", err)
+	}
+
+	if _, err := p.Authorize(source, &pb.AuthRequest{Token: testToken(t, jwt.MapClaims{"sub": "alice"})}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// Limited before the signature is checked
+	forged := testToken(t, jwt.MapClaims{"sub": "alice"}) + "x"
+	if _, err := p.Authorize(source, &pb.AuthRequest{Token: forged}); StatusOf(err) != pb.Status_RATE_LIMITED {
+		t.Errorf("subject over its limit returned %v", err)
+	}
+	if _, err := p.Authorize(source, &pb.AuthRequest{Token: testToken(t, jwt.MapClaims{"sub": "bob"})}); err != nil {
+		t.Errorf("limit was shared between subjects: %v", err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	p := newTestPipeline(t)
+	authorized := metrics.Authorizations.WithLabelValues("ssh", "alice")
+	before := testutil.ToFloat64(authorized)
+	if _, err := p.Authorize(net.ParseIP("192.0.2.1"), &pb.AuthRequest{Token: testToken(t, jwt.MapClaims{"sub": "alice"})}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if after := testutil.ToFloat64(authorized); after != before+1 {
+		t.Errorf("authorizations went from %v to %v", before, after)
+	}
+
+	rejected := metrics.Rejections.WithLabelValues(pb.Status_REPLAY.String())
+	before = testutil.ToFloat64(rejected)
+	Reject(replay.ErrReplayed)
+	if after := testutil.ToFloat64(rejected); after != before+1 {
+		t.Errorf("rejections went from %v to %v", before, after)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	p := newTestPipeline(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	logger, err := audit.New([]config.AuditSinkConfig{{Type: config.AUDIT_SINK_FILE, Path: path}})
+	if err != nil {
+		t.Fatalf("failed to create audit log: %v", err)
+	}
+	p.Audit = logger
+	source := net.ParseIP("192.0.2.1")
+
+	request := &pb.AuthRequest{Token: testToken(t, jwt.MapClaims{"sub": "alice", "iss": "idp", "jti": "audited"})}
+	reply, err := p.Authorize(source, request)
+	p.Record(TRANSPORT_UDP, source, request, reply, err)
+	_, err = p.Authorize(source, request)
+	p.Record(TRANSPORT_UDP, source, request, nil, err)
+	logger.Close()
+
+	data, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records, got %q", data)
+	}
+	var authorized, rejected audit.Record
+	json.Unmarshal([]byte(lines[0]), &authorized)
+	json.Unmarshal([]byte(lines[1]), &rejected)
+	if authorized.Decision != audit.DECISION_AUTHORIZED || authorized.Subject != "alice" || authorized.Issuer != "idp" ||
+		authorized.Jti != "audited" || authorized.Service != "ssh" || authorized.Expiration != reply.Expiration ||
+		authorized.Fingerprint != audit.Fingerprint(request.Token) || authorized.Source != "192.0.2.1" {
+		t.Errorf("unexpected authorized record %+v", authorized)
+	}
+	if rejected.Decision != audit.DECISION_REJECTED || rejected.Reason != pb.Status_REPLAY.String() {
+		t.Errorf("unexpected rejected record %+v", rejected)
+	}
+	if strings.Contains(string(data), request.Token) {
+		t.Errorf("audit log contains the token")
+	}
+}
+
+func TestSign(t *testing.T) {
+	p := newTestPipeline(t)
+	request := &pb.AuthRequest{Token: testToken(t, jwt.MapClaims{})}
+	reply := &pb.AuthReply{Socket: "127.0.0.1:22", Expiration: 1}
+	p.Sign(request, reply)
+	if reply.Signature != nil {
+		t.Errorf("reply signed without a signing key")
+	}
+
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	p.SigningKey = private
+	p.Sign(request, reply)
+	if err := signing.VerifyReply(public, request.Token, reply); err != nil {
+		t.Errorf("signed reply does not verify: %v", err)
+	}
+}
+
+func TestAuthorizeRejects(t *testing.T) {
+	p := newTestPipeline(t)
+	source := net.ParseIP("192.0.2.1")
+	replayed := testToken(t, jwt.MapClaims{"jti": "1"})
+	if _, err := p.Authorize(source, &pb.AuthRequest{Token: replayed}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	testCases := []struct {
+		name    string
+		request *pb.AuthRequest
+		code    codes.Code
+	}{
+		{"unknown service", &pb.AuthRequest{Token: testToken(t, jwt.MapClaims{"jti": "2"}), Service: "ftp"}, codes.NotFound},
+		{"bad signature", &pb.AuthRequest{Token: testToken(t, jwt.MapClaims{"jti": "3"}) + "x"}, codes.Unauthenticated},
+		{"expired", &pb.AuthRequest{Token: testToken(t, jwt.MapClaims{"jti": "4", "exp": time.Now().Add(-time.Hour).Unix()})}, codes.Unauthenticated},
+		{"replayed", &pb.AuthRequest{Token: replayed}, codes.PermissionDenied},
+		{"source not in cidr", &pb.AuthRequest{Token: testToken(t, jwt.MapClaims{"jti": "5", "cidr": "198.51.100.0/24"})}, codes.PermissionDenied},
+	}
+	for _, tc := range testCases {
+		_, err := p.Authorize(source, tc.request)
+		if err == nil {
+			t.Errorf("%s: expected error", tc.name)
+			continue
+		}
+		if code := status.Code(statusError(err, false)); code != tc.code {
+			t.Errorf("%s: status %v, expected %v (%v)", tc.name, code, tc.code, err)
+		}
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	testCases := []struct {
+		err  error
+		code codes.Code
+	}{
+		{&config.UnknownServiceError{Name: "ftp"}, codes.NotFound},
+		{&policy.DeniedError{Rule: "require[0]", Reason: "no"}, codes.PermissionDenied},
+		{replay.ErrMissingJti, codes.PermissionDenied},
+		{&token.ClaimError{Claim: "iss", Reason: "no"}, codes.Unauthenticated},
+		{rules.ErrAddressFamily, codes.FailedPrecondition},
+		{errors.New("something else"), codes.Internal},
+	}
+	for _, tc := range testCases {
+		if code := status.Code(statusError(tc.err, false)); code != tc.code {
+			t.Errorf("statusError(%v) = %v, expected %v", tc.err, code, tc.code)
+		}
+	}
+}
+
+func TestErrorReply(t *testing.T) {
+	testCases := []struct {
+		err    error
+		status pb.Status
+	}{
+		{&token.ClaimError{Claim: "exp", Reason: "expired"}, pb.Status_EXPIRED},
+		{rules.ErrTermExpired, pb.Status_EXPIRED},
+		{&token.ClaimError{Claim: "aud", Reason: "wrong audience"}, pb.Status_INVALID_CLAIMS},
+		{&jwt.ValidationError{Errors: jwt.ValidationErrorSignatureInvalid}, pb.Status_INVALID_SIGNATURE},
+		{replay.ErrReplayed, pb.Status_REPLAY},
+		{&policy.DeniedError{Rule: "require[0]", Reason: "no"}, pb.Status_POLICY_DENIED},
+		{fmt.Errorf("service ssh: %w", rules.ErrAddressFamily), pb.Status_UNSUPPORTED_ADDRESS_FAMILY},
+	}
+	for _, tc := range testCases {
+		reply := ErrorReply(tc.err, false)
+		if reply.Status != tc.status || reply.Message != tc.err.Error() {
+			t.Errorf("ErrorReply(%v) = %v, expected status %v", tc.err, reply, tc.status)
+		}
+		if hidden := ErrorReply(tc.err, true); hidden.Status != pb.Status_DENIED || hidden.Message != "" {
+			t.Errorf("ErrorReply(%v) with hidden details = %v", tc.err, hidden)
+		}
+	}
+
+	if reply := ErrorReply(errors.New("open /etc/jpat/secret: permission denied"), false); reply.Status != pb.Status_INTERNAL_ERROR || reply.Message != "internal error" {
+		t.Errorf("internal error reply leaked details: %v", reply)
+	}
+}
+
+// Write a self-signed certificate for 127.0.0.1, returning the cert and key paths
+func writeCertificate(t *testing.T) (string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "jpat test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestGrpcServer(t *testing.T) {
+	certFile, keyFile := writeCertificate(t)
+	server, err := NewGrpcServer(NewCurrent(newTestPipeline(t)), config.GrpcConfig{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go server.Serve(listener)
+	defer server.Stop()
+
+	pemData, _ := os.ReadFile(certFile)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pemData)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, listener.Addr().String(),
+		grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: roots})))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewJpatClient(conn)
+
+	reply, err := client.RequestAuthorization(ctx, &pb.AuthRequest{Token: testToken(t, jwt.MapClaims{})})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if reply.Socket != "127.0.0.1:22" {
+		t.Errorf("unexpected socket %s", reply.Socket)
+	}
+
+	_, err = client.RequestAuthorization(ctx, &pb.AuthRequest{Token: testToken(t, jwt.MapClaims{}), Service: "ftp"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("unknown service returned %v, expected NotFound", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "freshness.key")
+	os.WriteFile(keyFile, []byte("MDEyMzQ1Njc4OWFiY2RlZg=="), 0600)
+
+	appConfig := testConfig()
+	appConfig.Replay = config.ReplayConfig{Enabled: true}
+	appConfig.Freshness = config.FreshnessConfig{KeyFile: keyFile}
+	engine, _ := rules.New(rules.NewMemoryBackend(), config.FirewallConfig{})
+	t.Cleanup(engine.Close)
+	p := New(appConfig, engine, replay.New(0, false))
+	if err := p.LoadKeys(); err != nil {
+		t.Fatalf("failed to load keys: %v", err)
+	}
+
+	source := net.ParseIP("192.0.2.1")
+	request := &pb.AuthRequest{Token: testToken(t, jwt.MapClaims{}), Service: "ssh"}
+	freshness.Stamp([]byte("0123456789abcdef"), request, time.Now())
+	if _, err := p.Authorize(source, request); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// Rotate the token secret, change the TTL and deny a subject
+	rotated := testConfig()
+	rotated.Replay = config.ReplayConfig{Enabled: true, MaxEntries: 1000}
+	rotated.Freshness = appConfig.Freshness
+	rotated.Keyfunc = func(*jwt.Token) (interface{}, error) { return []byte("rotated"), nil }
+	service := rotated.Services["ssh"]
+	service.Ttl = 120
+	service.Authorization = config.AuthorizationConfig{Deny: []config.ClaimRule{{Claim: "sub", Equals: "mallory"}}}
+	rotated.Services["ssh"] = service
+	next, err := p.Reload(rotated)
+	if err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	if next.Engine != engine || next.Replay.Len() != 1 {
+		t.Errorf("engine and replay history were not carried over")
+	}
+
+	// The nonce and jti seen before the reload can't be replayed after it
+	if _, err := next.Authorize(source, request); StatusOf(err) != pb.Status_REPLAY {
+		t.Errorf("replayed request returned %v", err)
+	}
+	fresh := &pb.AuthRequest{Token: testToken(t, jwt.MapClaims{}), Service: "ssh"}
+	freshness.Stamp([]byte("0123456789abcdef"), fresh, time.Now())
+	if _, err := next.Authorize(source, fresh); StatusOf(err) != pb.Status_INVALID_SIGNATURE {
+		t.Errorf("token signed with the old secret returned %v", err)
+	}
+
+	signed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix(), "jti": "rotated"}).SignedString([]byte("rotated"))
+	request = &pb.AuthRequest{Token: signed, Service: "ssh"}
+	freshness.Stamp([]byte("0123456789abcdef"), request, time.Now())
+	reply, err := next.Authorize(source, request)
+	if err != nil {
+		t.Fatalf("token signed with the new secret returned %v", err)
+	}
+	if ttl := reply.Expiration - time.Now().Unix(); ttl < 110 {
+		t.Errorf("new TTL was not applied, term expires in %ds", ttl)
+	}
+	signed, _ = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix(), "jti": "mallory", "sub": "mallory"}).SignedString([]byte("rotated"))
+	request = &pb.AuthRequest{Token: signed, Service: "ssh"}
+	freshness.Stamp([]byte("0123456789abcdef"), request, time.Now())
+	if _, err := next.Authorize(source, request); StatusOf(err) != pb.Status_POLICY_DENIED {
+		t.Errorf("new service deny rule was not applied, got %v", err)
+	}
+
+	broken := testConfig()
+	broken.Signing = config.SigningConfig{PrivateKeyFile: filepath.Join(dir, "missing.pem")}
+	if _, err := p.Reload(broken); err == nil {
+		t.Errorf("a config naming a missing key was reloaded")
+	}
+}
@@ -0,0 +1,68 @@
+package pipeline
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/micrictor/jpat/internal/config"
+	"github.com/micrictor/jpat/internal/ratelimit"
+	"github.com/micrictor/jpat/internal/replay"
+)
+
+// Reload returns a pipeline using appConfig, with its keys loaded. The engine, the
+// audit log and the history used to catch replays and floods carry over, even if
+// their settings change, so terms already granted are untouched. p keeps serving until the caller swaps it out.
+func (p *Pipeline) Reload(appConfig *config.AppConfig) (*Pipeline, error) {
+	next := New(appConfig, p.Engine, nil)
+	next.Audit = p.Audit
+	if settings := appConfig.Replay; settings.Enabled {
+		switch {
+		case p.Replay == nil:
+			next.Replay = replay.New(settings.MaxEntries, settings.AllowSameSource)
+		case settings == p.Config.Replay:
+			next.Replay = p.Replay
+		default:
+			next.Replay = p.Replay.Reconfigure(settings.MaxEntries, settings.AllowSameSource)
+		}
+	}
+	next.SourceLimit = carryLimiter(p.SourceLimit, next.SourceLimit, p.Config.RateLimits.PerSource, appConfig.RateLimits.PerSource)
+	next.SubjectLimit = carryLimiter(p.SubjectLimit, next.SubjectLimit, p.Config.RateLimits.PerSubject, appConfig.RateLimits.PerSubject)
+	next.Freshness = p.Freshness
+	if err := next.LoadKeys(); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// Keep the buckets of the old limiter, if both the old and new configs enable it
+func carryLimiter(old *ratelimit.Limiter, created *ratelimit.Limiter, oldLimit config.RateLimitConfig, limit config.RateLimitConfig) *ratelimit.Limiter {
+	switch {
+	case old == nil || created == nil:
+		return created
+	case limit == oldLimit:
+		return old
+	default:
+		return old.Reconfigure(limit.Rate, limit.Burst, time.Now())
+	}
+}
+
+// Current holds the pipeline serving requests, so that a reload can swap it while
+// requests are in flight. Each request should Load the pipeline once and use it
+// throughout.
+type Current struct {
+	value atomic.Value
+}
+
+func NewCurrent(p *Pipeline) *Current {
+	c := &Current{}
+	c.Store(p)
+	return c
+}
+
+func (c *Current) Load() *Pipeline {
+	return c.value.Load().(*Pipeline)
+}
+
+func (c *Current) Store(p *Pipeline) {
+	c.value.Store(p)
+}
@@ -0,0 +1,163 @@
+package policy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/micrictor/jpat/internal/config"
+)
+
+// DeniedError is returned when a token's claims do not satisfy the configured
+// authorization policy. Rule names the rule that caused the rejection.
+type DeniedError struct {
+	Rule   string
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("authorization rule %s failed: %s", e.Rule, e.Reason)
+}
+
+// Evaluate checks the claims against every require and deny rule.
+// All require rules must match and no deny rule may match.
+func Evaluate(authorization config.AuthorizationConfig, claims jwt.MapClaims) error {
+	for i, rule := range authorization.Require {
+		if ok, reason := match(rule, claims); !ok {
+			return &DeniedError{Rule: ruleName("require", i, rule), Reason: reason}
+		}
+	}
+	for i, rule := range authorization.Deny {
+		if ok, _ := match(rule, claims); ok {
+			return &DeniedError{Rule: ruleName("deny", i, rule), Reason: "deny rule matched"}
+		}
+	}
+	return nil
+}
+
+func ruleName(section string, idx int, rule config.ClaimRule) string {
+	if rule.Name != "" {
+		return rule.Name
+	}
+	return fmt.Sprintf("%s[%d] (%s)", section, idx, rule.String())
+}
+
+// Report whether the rule matches the claims. If it does not, the second return
+// value describes why.
+func match(rule config.ClaimRule, claims jwt.MapClaims) (bool, string) {
+	value, present := claims[rule.Claim]
+
+	if rule.Present != nil {
+		if present != *rule.Present {
+			if present {
+				return false, fmt.Sprintf("claim %s is present", rule.Claim)
+			}
+			return false, fmt.Sprintf("claim %s is missing", rule.Claim)
+		}
+		return true, ""
+	}
+
+	if !present {
+		// A missing claim can't contain the excluded value
+		if rule.Excludes != "" {
+			return true, ""
+		}
+		return false, fmt.Sprintf("claim %s is missing", rule.Claim)
+	}
+
+	switch {
+	case rule.Equals != "":
+		if scalarString(value) != rule.Equals {
+			return false, fmt.Sprintf("claim %s is not %q", rule.Claim, rule.Equals)
+		}
+	case rule.Prefix != "":
+		if !strings.HasPrefix(scalarString(value), rule.Prefix) {
+			return false, fmt.Sprintf("claim %s does not start with %q", rule.Claim, rule.Prefix)
+		}
+	case rule.Contains != "":
+		if !listContains(value, rule.Contains) {
+			return false, fmt.Sprintf("claim %s does not contain %q", rule.Claim, rule.Contains)
+		}
+	case rule.Excludes != "":
+		if listContains(value, rule.Excludes) {
+			return false, fmt.Sprintf("claim %s contains %q", rule.Claim, rule.Excludes)
+		}
+	}
+	return true, ""
+}
+
+// Lists can't be compared as a single value, so they never equal a scalar.
+func scalarString(value interface{}) string {
+	switch v := value.(type) {
+	case []interface{}, map[string]interface{}:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// A string claim is treated as a list with a single element.
+func listContains(value interface{}, want string) bool {
+	list, ok := value.([]interface{})
+	if !ok {
+		return scalarString(value) == want
+	}
+	for _, item := range list {
+		if scalarString(item) == want {
+			return true
+		}
+	}
+	return false
+}
+
+// SourceNetwork checks the source address against the networks listed in the
+// named claim, which may be a single CIDR or IP, or a list of them. It returns
+// the first network containing the source, or nil if the claim isn't set and
+// isn't required.
+func SourceNetwork(claims jwt.MapClaims, claim string, required bool, source net.IP) (*net.IPNet, error) {
+	rule := fmt.Sprintf("source binding (%s)", claim)
+	value, present := claims[claim]
+	if !present {
+		if required {
+			return nil, &DeniedError{Rule: rule, Reason: fmt.Sprintf("claim %s is missing", claim)}
+		}
+		return nil, nil
+	}
+
+	values, ok := value.([]interface{})
+	if !ok {
+		values = []interface{}{value}
+	}
+	for _, item := range values {
+		network, err := parseNetwork(item)
+		if err != nil {
+			return nil, &DeniedError{Rule: rule, Reason: err.Error()}
+		}
+		if network.Contains(source) {
+			return network, nil
+		}
+	}
+	return nil, &DeniedError{Rule: rule, Reason: fmt.Sprintf("source %v is not permitted by claim %s", source, claim)}
+}
+
+// Parse a CIDR, or a bare IP as a single-address network
+func parseNetwork(value interface{}) (*net.IPNet, error) {
+	text, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid network %v", value)
+	}
+	if _, network, err := net.ParseCIDR(text); err == nil {
+		return network, nil
+	}
+	ip := net.ParseIP(text)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid network %q", text)
+	}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return &net.IPNet{IP: ipv4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
@@ -0,0 +1,165 @@
+package policy
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/micrictor/jpat/internal/config"
+)
+
+var present = true
+var absent = false
+
+// The example policy from the README
+var readmeAuthorization = config.AuthorizationConfig{
+	Require: []config.ClaimRule{
+		{Claim: "sub", Prefix: "employee:"},
+		{Name: "listings-admin", Claim: "roles", Contains: "commerce-listings-admin"},
+	},
+	Deny: []config.ClaimRule{
+		{Name: "no-doges", Claim: "roles", Contains: "doge"},
+	},
+}
+
+func TestEvaluate(t *testing.T) {
+	testCases := []struct {
+		name          string
+		authorization config.AuthorizationConfig
+		claims        jwt.MapClaims
+		failedRule    string
+	}{
+		{
+			"empty policy allows",
+			config.AuthorizationConfig{},
+			jwt.MapClaims{},
+			"",
+		},
+		{
+			"readme allows admin",
+			readmeAuthorization,
+			jwt.MapClaims{"sub": "employee:micrictor", "roles": []interface{}{"commerce-listings-admin"}},
+			"",
+		},
+		{
+			"readme rejects machine",
+			readmeAuthorization,
+			jwt.MapClaims{"sub": "machine:1234", "roles": []interface{}{"commerce-listings-admin"}},
+			`require[0] (sub prefix "employee:")`,
+		},
+		{
+			"readme rejects missing role",
+			readmeAuthorization,
+			jwt.MapClaims{"sub": "employee:micrictor", "roles": []interface{}{"developer"}},
+			"listings-admin",
+		},
+		{
+			"readme rejects doge",
+			readmeAuthorization,
+			jwt.MapClaims{"sub": "employee:micrictor", "roles": []interface{}{"commerce-listings-admin", "doge"}},
+			"no-doges",
+		},
+		{
+			"equals matches numbers",
+			config.AuthorizationConfig{Require: []config.ClaimRule{{Claim: "level", Equals: "3"}}},
+			jwt.MapClaims{"level": float64(3)},
+			"",
+		},
+		{
+			"equals rejects lists",
+			config.AuthorizationConfig{Require: []config.ClaimRule{{Name: "eq", Claim: "roles", Equals: "admin"}}},
+			jwt.MapClaims{"roles": []interface{}{"admin"}},
+			"eq",
+		},
+		{
+			"contains treats string as list",
+			config.AuthorizationConfig{Require: []config.ClaimRule{{Claim: "roles", Contains: "admin"}}},
+			jwt.MapClaims{"roles": "admin"},
+			"",
+		},
+		{
+			"excludes allows missing claim",
+			config.AuthorizationConfig{Require: []config.ClaimRule{{Claim: "roles", Excludes: "doge"}}},
+			jwt.MapClaims{},
+			"",
+		},
+		{
+			"excludes rejects member",
+			config.AuthorizationConfig{Require: []config.ClaimRule{{Name: "ex", Claim: "roles", Excludes: "doge"}}},
+			jwt.MapClaims{"roles": []interface{}{"doge"}},
+			"ex",
+		},
+		{
+			"present requires claim",
+			config.AuthorizationConfig{Require: []config.ClaimRule{{Name: "has-email", Claim: "email", Present: &present}}},
+			jwt.MapClaims{},
+			"has-email",
+		},
+		{
+			"absent rejects claim",
+			config.AuthorizationConfig{Require: []config.ClaimRule{{Name: "no-act", Claim: "act", Present: &absent}}},
+			jwt.MapClaims{"act": "someone"},
+			"no-act",
+		},
+	}
+	for _, tc := range testCases {
+		err := Evaluate(tc.authorization, tc.claims)
+		if tc.failedRule == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tc.name, err)
+			}
+			continue
+		}
+
+		var denied *DeniedError
+		if !errors.As(err, &denied) {
+			t.Errorf("%s: expected DeniedError, got %v", tc.name, err)
+			continue
+		}
+		if denied.Rule != tc.failedRule {
+			t.Errorf("%s: rule %q does not match expected rule %q", tc.name, denied.Rule, tc.failedRule)
+		}
+		if !strings.Contains(err.Error(), tc.failedRule) {
+			t.Errorf("%s: error %q does not name the failed rule", tc.name, err.Error())
+		}
+	}
+}
+
+func TestSourceNetwork(t *testing.T) {
+	testCases := []struct {
+		name     string
+		claims   jwt.MapClaims
+		required bool
+		source   string
+		network  string
+		denied   bool
+	}{
+		{"missing optional", jwt.MapClaims{}, false, "192.0.2.1", "", false},
+		{"missing required", jwt.MapClaims{}, true, "192.0.2.1", "", true},
+		{"cidr match", jwt.MapClaims{"cidr": "192.0.2.0/24"}, false, "192.0.2.1", "192.0.2.0/24", false},
+		{"cidr mismatch", jwt.MapClaims{"cidr": "192.0.2.0/24"}, false, "198.51.100.1", "", true},
+		{"bare ip", jwt.MapClaims{"cidr": "192.0.2.1"}, false, "192.0.2.1", "192.0.2.1/32", false},
+		{"list picks match", jwt.MapClaims{"cidr": []interface{}{"10.0.0.0/8", "192.0.2.0/28"}}, false, "192.0.2.1", "192.0.2.0/28", false},
+		{"ipv6", jwt.MapClaims{"cidr": "2001:db8::/32"}, false, "2001:db8::1", "2001:db8::/32", false},
+		{"garbage", jwt.MapClaims{"cidr": "not-a-network"}, false, "192.0.2.1", "", true},
+	}
+	for _, tc := range testCases {
+		network, err := SourceNetwork(tc.claims, "cidr", tc.required, net.ParseIP(tc.source))
+		var denied *DeniedError
+		if tc.denied != errors.As(err, &denied) {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		if tc.network == "" {
+			if network != nil {
+				t.Errorf("%s: unexpected network %v", tc.name, network)
+			}
+			continue
+		}
+		if network == nil || network.String() != tc.network {
+			t.Errorf("%s: network %v does not match expected network %s", tc.name, network, tc.network)
+		}
+	}
+}
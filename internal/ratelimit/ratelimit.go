@@ -0,0 +1,119 @@
+// Package ratelimit provides keyed token-bucket rate limits, used to stop a single
+// source or subject from flooding the server.
+package ratelimit
+
+import (
+	"container/list"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// Most keys a limiter tracks. Past this, the least recently used bucket is
+// forgotten, so a flood of distinct keys can't exhaust the server's memory.
+const MAX_BUCKETS = 100000
+
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// Limiter allows each key rate requests per second, with bursts of up to burst.
+type Limiter struct {
+	rate       float64
+	burst      float64
+	maxBuckets int
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	// Buckets ordered from most to least recently used
+	recent    *list.List
+	lastSweep time.Time
+}
+
+// Create a limiter. If burst is less than one, it is the rate rounded up.
+func New(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+	return &Limiter{
+		rate:       rate,
+		burst:      float64(burst),
+		maxBuckets: MAX_BUCKETS,
+		buckets:    make(map[string]*list.Element),
+		recent:     list.New(),
+	}
+}
+
+// Allow reports whether key may make a request at time now, taking a token if so
+func (l *Limiter) Allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) > l.fillTime() {
+		l.sweep(now)
+	}
+
+	var b *bucket
+	if elem, ok := l.buckets[key]; ok {
+		l.recent.MoveToFront(elem)
+		b = elem.Value.(*bucket)
+	} else {
+		if len(l.buckets) >= l.maxBuckets {
+			l.remove(l.recent.Back())
+		}
+		b = &bucket{key: key, tokens: l.burst, last: now}
+		l.buckets[key] = l.recent.PushFront(b)
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Reconfigure returns a limiter with the new rate and burst that keeps l's
+// buckets, so a reload doesn't hand every key a full burst
+func (l *Limiter) Reconfigure(rate float64, burst int, now time.Time) *Limiter {
+	next := New(rate, burst)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for elem := l.recent.Front(); elem != nil; elem = elem.Next() {
+		b := elem.Value.(*bucket)
+		next.buckets[b.key] = next.recent.PushBack(&bucket{key: b.key, tokens: math.Min(next.burst, l.refill(b, now)), last: now})
+	}
+	next.lastSweep = now
+	return next
+}
+
+func (l *Limiter) refill(b *bucket, now time.Time) float64 {
+	return math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+}
+
+// How long an empty bucket takes to fill
+func (l *Limiter) fillTime() time.Duration {
+	return time.Duration(l.burst / l.rate * float64(time.Second))
+}
+
+// Forget full buckets, which behave the same as new ones. Must hold mu.
+func (l *Limiter) sweep(now time.Time) {
+	for elem := l.recent.Front(); elem != nil; {
+		next := elem.Next()
+		if l.refill(elem.Value.(*bucket), now) >= l.burst {
+			l.remove(elem)
+		}
+		elem = next
+	}
+	l.lastSweep = now
+}
+
+// Must hold mu.
+func (l *Limiter) remove(elem *list.Element) {
+	delete(l.buckets, elem.Value.(*bucket).key)
+	l.recent.Remove(elem)
+}
@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	limiter := New(1, 3)
+	now := time.Unix(1700000000, 0)
+
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow("a", now) {
+			t.Fatalf("request %d within the burst was limited", i)
+		}
+	}
+	if limiter.Allow("a", now) {
+		t.Errorf("request over the burst was allowed")
+	}
+	if !limiter.Allow("b", now) {
+		t.Errorf("limit was shared between keys")
+	}
+	if !limiter.Allow("a", now.Add(time.Second)) {
+		t.Errorf("bucket did not refill")
+	}
+	if limiter.Allow("a", now.Add(time.Second)) {
+		t.Errorf("bucket refilled more than the rate")
+	}
+}
+
+func TestDefaultBurst(t *testing.T) {
+	limiter := New(0.5, 0)
+	now := time.Unix(1700000000, 0)
+	if !limiter.Allow("a", now) || limiter.Allow("a", now) {
+		t.Errorf("expected a burst of 1")
+	}
+	if limiter.Allow("a", now.Add(time.Second)) || !limiter.Allow("a", now.Add(2*time.Second)) {
+		t.Errorf("expected one request every 2 seconds")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	limiter := New(1, 2)
+	now := time.Unix(1700000000, 0)
+	limiter.Allow("a", now)
+	limiter.Allow("b", now)
+	later := now.Add(time.Minute)
+	limiter.Allow("c", later)
+	if len(limiter.buckets) != 1 {
+		t.Errorf("expected full buckets to be swept, have %d", len(limiter.buckets))
+	}
+}
+
+func TestMaxBuckets(t *testing.T) {
+	limiter := New(1, 1)
+	limiter.maxBuckets = 2
+	now := time.Unix(1700000000, 0)
+	limiter.Allow("a", now)
+	limiter.Allow("b", now)
+	limiter.Allow("a", now)
+	limiter.Allow("c", now)
+
+	// b was the least recently used, so its bucket was forgotten
+	if len(limiter.buckets) != 2 {
+		t.Errorf("expected 2 buckets, have %d", len(limiter.buckets))
+	}
+	if !limiter.Allow("b", now) {
+		t.Errorf("expected b to get a new bucket")
+	}
+	if limiter.Allow("c", now) {
+		t.Errorf("expected c to keep its empty bucket")
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	limiter := New(1, 3)
+	now := time.Unix(1700000000, 0)
+	for i := 0; i < 3; i++ {
+		limiter.Allow("a", now)
+	}
+
+	// An empty bucket stays empty, and a full one is capped at the new burst
+	next := limiter.Reconfigure(1, 5, now)
+	if next.Allow("a", now) {
+		t.Errorf("bucket was refilled by reconfiguring")
+	}
+	next = limiter.Reconfigure(2, 1, now.Add(time.Minute))
+	if !next.Allow("a", now.Add(time.Minute)) || next.Allow("a", now.Add(time.Minute)) {
+		t.Errorf("expected the new burst of 1")
+	}
+}
@@ -0,0 +1,139 @@
+package replay
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const DEFAULT_MAX_ENTRIES = 100000
+
+var ErrMissingJti = errors.New("token has no jti claim")
+var ErrReplayed = errors.New("token jti has already been used")
+
+type entry struct {
+	jti        string
+	expiration int64
+	source     net.IP
+}
+
+// Min-heap of entries ordered by expiration, used to find entries to evict.
+type expirationHeap []*entry
+
+func (h expirationHeap) Len() int            { return len(h) }
+func (h expirationHeap) Less(i, j int) bool  { return h[i].expiration < h[j].expiration }
+func (h expirationHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expirationHeap) Push(x interface{}) { *h = append(*h, x.(*entry)) }
+func (h *expirationHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// Cache remembers the jti of every token it has seen until the token expires.
+type Cache struct {
+	maxEntries      int
+	allowSameSource bool
+
+	mu          sync.Mutex
+	entries     map[string]*entry
+	expirations expirationHeap
+}
+
+// Create a cache holding at most maxEntries jti values. If allowSameSource is
+// set, a jti may be reused from the address that first presented it.
+func New(maxEntries int, allowSameSource bool) *Cache {
+	if maxEntries <= 0 {
+		maxEntries = DEFAULT_MAX_ENTRIES
+	}
+	return &Cache{
+		maxEntries:      maxEntries,
+		allowSameSource: allowSameSource,
+		entries:         make(map[string]*entry),
+	}
+}
+
+// Check a verified token, recording its jti if it hasn't been seen before.
+func (c *Cache) CheckToken(token *jwt.Token, source net.IP) error {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return fmt.Errorf("failed to get token claims")
+	}
+	jti, ok := claims["jti"].(string)
+	if !ok || jti == "" {
+		return ErrMissingJti
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("failed to get token exp")
+	}
+	return c.Check(jti, int64(exp), source)
+}
+
+// Check the jti, recording it until expiration if it hasn't been seen before.
+func (c *Cache) Check(jti string, expiration int64, source net.IP) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeExpired(time.Now().Unix())
+
+	if seen, ok := c.entries[jti]; ok {
+		if c.allowSameSource && seen.source.Equal(source) {
+			return nil
+		}
+		return ErrReplayed
+	}
+
+	if len(c.entries) >= c.maxEntries {
+		evicted := heap.Pop(&c.expirations).(*entry)
+		delete(c.entries, evicted.jti)
+		log.Printf("replay cache is full, evicted jti %s early", evicted.jti)
+	}
+
+	newEntry := &entry{jti: jti, expiration: expiration, source: source}
+	c.entries[jti] = newEntry
+	heap.Push(&c.expirations, newEntry)
+	return nil
+}
+
+// Reconfigure returns a cache with the new settings that remembers every jti c
+// has seen, so tokens used before a reload can't be replayed after it. If there
+// are more than maxEntries, the entries expiring first are dropped, as in Check.
+func (c *Cache) Reconfigure(maxEntries int, allowSameSource bool) *Cache {
+	next := New(maxEntries, allowSameSource)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sorted := append(expirationHeap{}, c.expirations...)
+	for skip := len(sorted) - next.maxEntries; sorted.Len() > 0; skip-- {
+		old := heap.Pop(&sorted).(*entry)
+		if skip > 0 {
+			continue
+		}
+		copied := *old
+		next.entries[copied.jti] = &copied
+		heap.Push(&next.expirations, &copied)
+	}
+	return next
+}
+
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Must be called with the lock held.
+func (c *Cache) removeExpired(now int64) {
+	for len(c.expirations) > 0 && c.expirations[0].expiration <= now {
+		expired := heap.Pop(&c.expirations).(*entry)
+		delete(c.entries, expired.jti)
+	}
+}
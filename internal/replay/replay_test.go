@@ -0,0 +1,115 @@
+package replay
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+var sourceA = net.ParseIP("192.0.2.1")
+var sourceB = net.ParseIP("192.0.2.2")
+
+func TestCheck(t *testing.T) {
+	exp := time.Now().Add(time.Minute).Unix()
+	testCases := []struct {
+		allowSameSource bool
+		jti             string
+		source          net.IP
+		expected        error
+	}{
+		{false, "one", sourceA, nil},
+		{false, "one", sourceA, ErrReplayed},
+		{false, "one", sourceB, ErrReplayed},
+		{true, "one", sourceA, nil},
+		{true, "one", sourceA, nil},
+		{true, "one", sourceB, ErrReplayed},
+	}
+
+	var cache *Cache
+	for i, tc := range testCases {
+		// Each allowSameSource setting starts with a fresh cache
+		if i == 0 || testCases[i-1].allowSameSource != tc.allowSameSource {
+			cache = New(10, tc.allowSameSource)
+		}
+		err := cache.Check(tc.jti, exp, tc.source)
+		if !errors.Is(err, tc.expected) {
+			t.Errorf("case %d: got error %v, expected %v", i, err, tc.expected)
+		}
+	}
+}
+
+func TestCheckExpired(t *testing.T) {
+	cache := New(10, false)
+	if err := cache.Check("old", time.Now().Unix()-1, sourceA); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// The old entry is removed before the new one is checked
+	if err := cache.Check("new", time.Now().Add(time.Minute).Unix(), sourceA); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if cache.Len() != 1 {
+		t.Errorf("expected expired entry to be removed, have %d entries", cache.Len())
+	}
+}
+
+func TestCheckEvictsEarliestExpiration(t *testing.T) {
+	now := time.Now().Unix()
+	cache := New(2, false)
+	cache.Check("late", now+300, sourceA)
+	cache.Check("early", now+100, sourceA)
+	cache.Check("middle", now+200, sourceA)
+
+	if cache.Len() != 2 {
+		t.Errorf("cache exceeded its bound, have %d entries", cache.Len())
+	}
+	if err := cache.Check("late", now+300, sourceA); !errors.Is(err, ErrReplayed) {
+		t.Errorf("late entry was evicted")
+	}
+	if err := cache.Check("early", now+100, sourceB); err != nil {
+		t.Errorf("early entry was not evicted")
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	now := time.Now().Unix()
+	cache := New(10, false)
+	cache.Check("late", now+300, sourceA)
+	cache.Check("early", now+100, sourceA)
+	cache.Check("middle", now+200, sourceA)
+
+	// Shrinking the cache drops the entries expiring first
+	next := cache.Reconfigure(2, true)
+	if next.Len() != 2 {
+		t.Errorf("expected 2 entries, have %d", next.Len())
+	}
+	if err := next.Check("late", now+300, sourceB); !errors.Is(err, ErrReplayed) {
+		t.Errorf("late entry was forgotten")
+	}
+	if err := next.Check("middle", now+200, sourceA); err != nil {
+		t.Errorf("new allowSameSource setting was not applied: %v", err)
+	}
+	if err := cache.Check("early", now+100, sourceB); !errors.Is(err, ErrReplayed) {
+		t.Errorf("the old cache was changed")
+	}
+}
+
+func TestCheckToken(t *testing.T) {
+	cache := New(10, false)
+	exp := float64(time.Now().Add(time.Minute).Unix())
+
+	missing := &jwt.Token{Claims: jwt.MapClaims{"exp": exp}}
+	if err := cache.CheckToken(missing, sourceA); !errors.Is(err, ErrMissingJti) {
+		t.Errorf("expected missing jti error, got %v", err)
+	}
+
+	token := &jwt.Token{Claims: jwt.MapClaims{"exp": exp, "jti": "abc"}}
+	if err := cache.CheckToken(token, sourceA); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := cache.CheckToken(token, sourceA); !errors.Is(err, ErrReplayed) {
+		t.Errorf("expected replay error, got %v", err)
+	}
+}
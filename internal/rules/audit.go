@@ -0,0 +1,49 @@
+package rules
+
+import (
+	"github.com/micrictor/jpat/internal/audit"
+)
+
+// auditedBackend records every term applied to or deleted from the backend
+type auditedBackend struct {
+	Backend
+	logger *audit.Logger
+}
+
+// NewAuditedBackend wraps backend, logging its term changes to logger
+func NewAuditedBackend(backend Backend, logger *audit.Logger) Backend {
+	return &auditedBackend{Backend: backend, logger: logger}
+}
+
+func (b *auditedBackend) Apply(term Term) error {
+	err := b.Backend.Apply(term)
+	b.logger.Log(termRecord(audit.EVENT_TERM_APPLIED, term, err))
+	return err
+}
+
+func (b *auditedBackend) Delete(term Term) error {
+	err := b.Backend.Delete(term)
+	b.logger.Log(termRecord(audit.EVENT_TERM_DELETED, term, err))
+	return err
+}
+
+func (b *auditedBackend) Flush() error {
+	err := b.Backend.Flush()
+	b.logger.Log(termRecord(audit.EVENT_TERM_DELETED, Term{Comment: "all"}, err))
+	return err
+}
+
+func termRecord(event string, term Term, err error) audit.Record {
+	record := audit.Record{
+		Event:      event,
+		Term:       term.Comment,
+		Expiration: term.Expiration,
+	}
+	if term.SourceAddr != nil || term.SourceNet != nil {
+		record.Source = term.Source().String()
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	return record
+}
@@ -0,0 +1,35 @@
+package rules
+
+import (
+	"fmt"
+
+	"github.com/micrictor/jpat/internal/config"
+)
+
+// Backend programs terms into a firewall.
+type Backend interface {
+	// Apply opens the firewall for the term
+	Apply(term Term) error
+	// Delete closes the firewall for a previously applied term
+	Delete(term Term) error
+	// List returns the terms currently applied by the backend
+	List() ([]Term, error)
+	// Flush deletes every term applied by the backend
+	Flush() error
+	// Close removes anything the backend added to the firewall besides terms
+	Close() error
+}
+
+// Create the backend selected in the firewall config. An empty name selects
+// the platform's default backend.
+func NewBackend(appConfig *config.AppConfig) (Backend, error) {
+	firewall := appConfig.Firewall
+	if firewall.Backend == config.FIREWALL_MEMORY {
+		return NewMemoryBackend(), nil
+	}
+	backend, err := newPlatformBackend(appConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s backend: %v", firewall.Backend, err)
+	}
+	return backend, nil
+}
@@ -0,0 +1,76 @@
+package rules
+
+import "sync"
+
+// MemoryBackend is a Backend that records terms without touching the host
+// firewall. It is useful for tests and dry runs.
+type MemoryBackend struct {
+	mu      sync.Mutex
+	active  []Term
+	applied []Term
+	deleted []Term
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{}
+}
+
+// Apply records the term. Like the firewall backends, applying a term whose rule
+// is already active leaves a single rule.
+func (m *MemoryBackend) Apply(term Term) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.applied = append(m.applied, term)
+	for _, active := range m.active {
+		if active.key() == term.key() {
+			return nil
+		}
+	}
+	m.active = append(m.active, term)
+	return nil
+}
+
+func (m *MemoryBackend) Delete(term Term) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleted = append(m.deleted, term)
+	for i, active := range m.active {
+		if active.key() == term.key() {
+			m.active = append(m.active[:i], m.active[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *MemoryBackend) List() ([]Term, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Term{}, m.active...), nil
+}
+
+func (m *MemoryBackend) Flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleted = append(m.deleted, m.active...)
+	m.active = nil
+	return nil
+}
+
+func (m *MemoryBackend) Close() error {
+	return nil
+}
+
+// Applied returns every term passed to Apply, in order.
+func (m *MemoryBackend) Applied() []Term {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Term{}, m.applied...)
+}
+
+// Deleted returns every term removed by Delete or Flush, in order.
+func (m *MemoryBackend) Deleted() []Term {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Term{}, m.deleted...)
+}
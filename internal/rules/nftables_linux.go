@@ -0,0 +1,479 @@
+//go:build linux
+
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/micrictor/jpat/internal/config"
+	"golang.org/x/sys/unix"
+)
+
+const NFT_TABLE = "jpat"
+const NFT_CHAIN = "input"
+
+// nftablesBackend programs terms into a dedicated inet table. Each distinct
+// destination gets a "guard": sets of allowed sources with per-element timeouts,
+// rules accepting sources in the sets, and a rule dropping everything else. A
+// destination with several port ranges gets rules for each range.
+//
+// Sources are kept in one interval set per prefix length, as the kernel rejects
+// overlapping intervals and a /32 may be inside an active /24. Networks of the
+// same length are either identical, and share an element, or disjoint. Accept
+// rules are inserted at the head of the chain, so they come before every drop.
+//
+// The drop is needed because an accept in one nftables base chain does not stop
+// another table from dropping the packet, so the guard has to be the one closing
+// the port. Every service gets its guards at startup, whatever dropUnmatched
+// says, and the table is deleted on Close. Because elements carry their own
+// timeouts, the kernel removes them even if the server dies without cleaning up.
+type nftablesBackend struct {
+	mu     sync.Mutex
+	conn   *nftables.Conn
+	table  *nftables.Table
+	chain  *nftables.Chain
+	guards map[string]*nftGuard
+	active []Term
+}
+
+type nftGuard struct {
+	key         string
+	name        string
+	destination net.IP
+	keyType     nftables.SetDatatype
+	// Sets of allowed sources, by prefix length
+	sets map[int]*nftables.Set
+}
+
+// Create the table and chain, and a guard for every address of every service.
+// Rules a previous run left for other destinations are removed.
+func newNftablesBackend(services map[string]config.ServiceConfig) (*nftablesBackend, error) {
+	conn := &nftables.Conn{}
+	table := conn.AddTable(&nftables.Table{
+		Name:   NFT_TABLE,
+		Family: nftables.TableFamilyINet,
+	})
+	chain := conn.AddChain(&nftables.Chain{
+		Name:     NFT_CHAIN,
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+	})
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to create nftables table: %v", err)
+	}
+
+	n := &nftablesBackend{
+		conn:   conn,
+		table:  table,
+		chain:  chain,
+		guards: make(map[string]*nftGuard),
+	}
+
+	// Sorted so the drops are programmed in the same order on every start
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var guarded []Term
+	keep := make(map[string]bool)
+	for _, name := range names {
+		service := services[name]
+		for _, address := range service.Addresses() {
+			term := Term{DestinationAddr: address, DestinationPorts: service.PortRanges(), Protocol: service.Protocol}
+			guarded = append(guarded, term)
+			keep[guardKey(term)] = true
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.removeStale(keep); err != nil {
+		return nil, err
+	}
+	for _, term := range guarded {
+		if _, err := n.getOrCreateGuard(term); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func (n *nftablesBackend) Apply(term Term) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// The term's element is already in place
+	for _, active := range n.active {
+		if active.key() == term.key() {
+			return nil
+		}
+	}
+
+	set, err := n.getOrCreateSet(term)
+	if err != nil {
+		return err
+	}
+
+	timeout := time.Until(time.Unix(term.Expiration, 0))
+	if timeout < time.Second {
+		return fmt.Errorf("term for %v has already expired", term.Source())
+	}
+	// Adding an element that already exists leaves its timeout unchanged, so
+	// replace it in the same batch when a later term for the source arrives
+	if previous, ok := n.sharedTerm(term); ok {
+		if previous.Expiration < term.Expiration {
+			if err := n.conn.SetDeleteElements(set, sourceElements(term.Source(), 0)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := n.conn.SetAddElements(set, sourceElements(term.Source(), timeout)); err != nil {
+		return err
+	}
+	if err := n.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to add set element: %v", err)
+	}
+	n.active = append(n.active, term)
+	return nil
+}
+
+func (n *nftablesBackend) Delete(term Term) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	set, err := n.getOrCreateSet(term)
+	if err != nil {
+		return err
+	}
+
+	n.removeActive(term)
+	// Another term still needs the element
+	if _, ok := n.sharedTerm(term); ok {
+		return nil
+	}
+
+	if err := n.conn.SetDeleteElements(set, sourceElements(term.Source(), 0)); err != nil {
+		return err
+	}
+	err = n.conn.Flush()
+	// The kernel may have already timed the element out
+	if err != nil && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("failed to delete set element: %v", err)
+	}
+	return nil
+}
+
+// Find another active term using the same set element as term, keeping the
+// latest expiration. Must be called with the lock held.
+func (n *nftablesBackend) sharedTerm(term Term) (Term, bool) {
+	var shared Term
+	found := false
+	for _, active := range n.active {
+		if active.key() == term.key() || guardKey(active) != guardKey(term) || active.Source().String() != term.Source().String() {
+			continue
+		}
+		if !found || active.Expiration > shared.Expiration {
+			shared = active
+			found = true
+		}
+	}
+	return shared, found
+}
+
+// Must be called with the lock held.
+func (n *nftablesBackend) removeActive(term Term) {
+	for i, active := range n.active {
+		if active.key() == term.key() {
+			n.active = append(n.active[:i], n.active[i+1:]...)
+			break
+		}
+	}
+}
+
+func (n *nftablesBackend) List() ([]Term, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]Term{}, n.active...), nil
+}
+
+func (n *nftablesBackend) Flush() error {
+	terms, _ := n.List()
+	for _, term := range terms {
+		if err := n.Delete(term); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete the table, along with every guard. Terms are deleted before Close, so
+// this only removes the drops.
+func (n *nftablesBackend) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.conn.DelTable(n.table)
+	if err := n.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to delete nftables table: %v", err)
+	}
+	return nil
+}
+
+// Delete the rules and sets of guards whose keys aren't in keep. Must be called
+// with the lock held.
+func (n *nftablesBackend) removeStale(keep map[string]bool) error {
+	rules, err := n.conn.GetRule(n.table, n.chain)
+	if err != nil {
+		return fmt.Errorf("failed to list rules: %v", err)
+	}
+	stale := make(map[string]bool)
+	for _, rule := range rules {
+		// Accept rules are tagged with the guard key and prefix length
+		key := strings.SplitN(string(rule.UserData), "#", 2)[0]
+		if !strings.HasPrefix(key, COMMENT_PREFIX) || keep[key] {
+			continue
+		}
+		// Listed rules don't carry the table's family, which deleting needs
+		rule.Table, rule.Chain = n.table, n.chain
+		if err := n.conn.DelRule(rule); err != nil {
+			return err
+		}
+		stale[guardName(key)] = true
+	}
+	sets, err := n.conn.GetSets(n.table)
+	if err != nil {
+		return fmt.Errorf("failed to list sets: %v", err)
+	}
+	for _, set := range sets {
+		if idx := strings.LastIndex(set.Name, "_"); idx >= 0 && stale[set.Name[:idx]] {
+			n.conn.DelSet(set)
+		}
+	}
+	if err := n.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to remove stale rules: %v", err)
+	}
+	return nil
+}
+
+// Get the guard for the term's destination, creating it and its drop rules if
+// needed. Must be called with the lock held.
+func (n *nftablesBackend) getOrCreateGuard(term Term) (*nftGuard, error) {
+	key := guardKey(term)
+	if guard, ok := n.guards[key]; ok {
+		return guard, nil
+	}
+
+	destination := term.DestinationAddr.To4()
+	keyType := nftables.TypeIPAddr
+	if destination == nil {
+		destination = term.DestinationAddr.To16()
+		keyType = nftables.TypeIP6Addr
+	}
+	if destination == nil {
+		return nil, fmt.Errorf("invalid destination address %v", term.DestinationAddr)
+	}
+
+	// Names are derived from the destination so a restarted server finds the
+	// sets it created before, along with any elements that haven't expired.
+	guard := &nftGuard{
+		key:         key,
+		name:        guardName(key),
+		destination: destination,
+		keyType:     keyType,
+		sets:        make(map[int]*nftables.Set),
+	}
+
+	exists, err := n.hasRules(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		match, err := destinationMatch(term, destination)
+		if err != nil {
+			return nil, err
+		}
+		for _, port := range term.DestinationPorts {
+			drop := append(append([]expr.Any{}, match...), nftPortMatch(port)...)
+			drop = append(drop, &expr.Verdict{Kind: expr.VerdictDrop})
+			n.conn.AddRule(&nftables.Rule{Table: n.table, Chain: n.chain, Exprs: drop, UserData: []byte(key)})
+		}
+		if err := n.conn.Flush(); err != nil {
+			return nil, fmt.Errorf("failed to add rules for %s: %v", key, err)
+		}
+	}
+
+	n.guards[key] = guard
+	return guard, nil
+}
+
+// Get the guard's set for sources with the term's prefix length, creating it and
+// its accept rules if needed. Must be called with the lock held.
+func (n *nftablesBackend) getOrCreateSet(term Term) (*nftables.Set, error) {
+	guard, err := n.getOrCreateGuard(term)
+	if err != nil {
+		return nil, err
+	}
+	ones, _ := term.Source().Mask.Size()
+	if set, ok := guard.sets[ones]; ok {
+		return set, nil
+	}
+
+	set := &nftables.Set{
+		Table:      n.table,
+		Name:       fmt.Sprintf("%s_%d", guard.name, ones),
+		KeyType:    guard.keyType,
+		Interval:   true,
+		HasTimeout: true,
+	}
+	if err := n.conn.AddSet(set, nil); err != nil {
+		return nil, err
+	}
+	if err := n.conn.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to create set %s: %v", set.Name, err)
+	}
+
+	userData := fmt.Sprintf("%s#%d", guard.key, ones)
+	exists, err := n.hasRules(userData)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		match, err := destinationMatch(term, guard.destination)
+		if err != nil {
+			return nil, err
+		}
+		// Every range gets its own rule, all sharing the set, so the ranges open
+		// and close together
+		for _, port := range term.DestinationPorts {
+			accept := append(append([]expr.Any{}, match...), nftPortMatch(port)...)
+			accept = append(accept, sourceLookup(set, len(guard.destination))...)
+			accept = append(accept, &expr.Verdict{Kind: expr.VerdictAccept})
+			n.conn.InsertRule(&nftables.Rule{Table: n.table, Chain: n.chain, Exprs: accept, UserData: []byte(userData)})
+		}
+		if err := n.conn.Flush(); err != nil {
+			return nil, fmt.Errorf("failed to add rules for %s: %v", set.Name, err)
+		}
+	}
+
+	guard.sets[ones] = set
+	return set, nil
+}
+
+// Report whether the chain has rules tagged with userData. Must be called with
+// the lock held.
+func (n *nftablesBackend) hasRules(userData string) (bool, error) {
+	existing, err := n.conn.GetRule(n.table, n.chain)
+	if err != nil {
+		return false, fmt.Errorf("failed to list rules: %v", err)
+	}
+	for _, rule := range existing {
+		if string(rule.UserData) == userData {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Prefix of the names of the guard's sets
+func guardName(key string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return fmt.Sprintf("allow_%08x", hash.Sum32())
+}
+
+func guardKey(term Term) string {
+	protocol := strings.ToLower(term.Protocol)
+	if protocol == "" {
+		protocol = DEFAULT_PROTOCOL
+	}
+	return fmt.Sprintf("jpat:%s/%v/%s", protocol, term.DestinationAddr, formatPorts(term.DestinationPorts))
+}
+
+// Match the term's protocol and destination address
+func destinationMatch(term Term, destination net.IP) ([]expr.Any, error) {
+	var protocol byte
+	switch strings.ToLower(term.Protocol) {
+	case "", "tcp":
+		protocol = unix.IPPROTO_TCP
+	case "udp":
+		protocol = unix.IPPROTO_UDP
+	default:
+		return nil, fmt.Errorf("unsupported protocol %s", term.Protocol)
+	}
+
+	family := byte(unix.NFPROTO_IPV4)
+	addressOffset := uint32(16)
+	if len(destination) == net.IPv6len {
+		family = unix.NFPROTO_IPV6
+		addressOffset = 24
+	}
+
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{protocol}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: addressOffset, Len: uint32(len(destination))},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: destination},
+	}, nil
+}
+
+// Match a destination port in the range
+func nftPortMatch(port config.PortRange) []expr.Any {
+	load := &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2}
+	if port.From == port.To {
+		return []expr.Any{load, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(port.From)}}
+	}
+	return []expr.Any{load, &expr.Range{
+		Op:       expr.CmpOpEq,
+		Register: 1,
+		FromData: binaryutil.BigEndian.PutUint16(port.From),
+		ToData:   binaryutil.BigEndian.PutUint16(port.To),
+	}}
+}
+
+// Look the packet's source address up in the set
+func sourceLookup(set *nftables.Set, addressLen int) []expr.Any {
+	offset := uint32(12)
+	if addressLen == net.IPv6len {
+		offset = 8
+	}
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(addressLen)},
+		&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+	}
+}
+
+// Interval sets store a network as its first address and the address after its last.
+func sourceElements(network *net.IPNet, timeout time.Duration) []nftables.SetElement {
+	start := network.IP.Mask(network.Mask)
+	if ipv4 := start.To4(); ipv4 != nil {
+		start = ipv4
+	}
+
+	ones, bits := network.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	end := new(big.Int).Add(new(big.Int).SetBytes(start), size)
+
+	elements := []nftables.SetElement{{Key: start, Timeout: timeout}}
+	// The end of the last network in the address space can't be represented
+	if end.BitLen() <= bits {
+		endBytes := make([]byte, len(start))
+		end.FillBytes(endBytes)
+		elements = append(elements, nftables.SetElement{Key: endBytes, IntervalEnd: true})
+	}
+	return elements
+}
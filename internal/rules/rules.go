@@ -6,105 +6,368 @@ import (
 	"log"
 	"math"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt"
 	"github.com/micrictor/jpat/internal/config"
+	"github.com/micrictor/jpat/internal/metrics"
+	"github.com/micrictor/jpat/internal/policy"
 )
 
+// ErrAddressFamily is returned when a service can't be reached over the client's IP version
+var ErrAddressFamily = errors.New("service has no address in the client's address family")
+
+// ErrNoSuchTerm is returned when no active term has the requested ID
+var ErrNoSuchTerm = errors.New("no active term has that ID")
+
+// ErrTermExpired is returned for a token accepted within the leeway whose exp has
+// already passed, which would open a term that has already expired
+var ErrTermExpired = errors.New("token expires before the term could be opened")
+
+// TermFilter selects active terms. Every field that is set must match.
+type TermFilter struct {
+	ID string
+	// Matches terms permitting traffic from this address
+	Source  net.IP
+	Subject string
+	// Matches every term, for flushing
+	All bool
+}
+
+func (f TermFilter) empty() bool {
+	return f.ID == "" && f.Source == nil && f.Subject == "" && !f.All
+}
+
+func (f TermFilter) matches(term Term) bool {
+	if f.ID != "" && term.ID != f.ID {
+		return false
+	}
+	if f.Source != nil && !term.Source().Contains(f.Source) {
+		return false
+	}
+	if f.Subject != "" && term.Subject != f.Subject {
+		return false
+	}
+	return true
+}
+
 type RulesEngine struct {
-	// activeTerms will maintain the state of currently open terms.
-	// It is sorted by expiration time at insertion
-	activeTerms []Term
+	// backend programs terms into the firewall
+	backend Backend
+	// scheduler maintains the state of currently open terms, and deletes them
+	// from the backend as they expire
+	scheduler *scheduler
+	// Closed to stop the periodic reconciler
+	stopReconciler chan struct{}
+	closeOnce      sync.Once
+
+	// Keys of terms being applied but not yet scheduled, which the reconciler
+	// must not adopt
+	pendingMu sync.Mutex
+	pending   map[string]int
 }
 
-// Attempt to add a term for a given token and source address.
-// Will return errors if the JWT is invalid.
-func (r *RulesEngine) TryAddTerm(sourceAddr *net.UDPAddr, token *jwt.Token, appConfig *config.AppConfig) (int64, error) {
+// NewTerm builds the term opening the service for a given token and source address,
+// without applying it. Will return errors if the JWT is invalid or its claims fail
+// the global or the service's authorization policy.
+func (r *RulesEngine) NewTerm(sourceAddr net.IP, token *jwt.Token, service config.ServiceConfig, appConfig *config.AppConfig) (Term, error) {
 	if !token.Valid {
-		return 0, errors.New("token is not valid")
+		return Term{}, errors.New("token is not valid")
 	}
 
-	service := appConfig.Service
+	// A dual-stack socket reports IPv4 sources as IPv4-mapped IPv6 addresses
+	source := sourceAddr
+	if ipv4 := source.To4(); ipv4 != nil {
+		source = ipv4
+	}
+	destination, ok := service.AddressFor(source)
+	if !ok {
+		return Term{}, fmt.Errorf("service %s, source %v: %w", service.Name, source, ErrAddressFamily)
+	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
-		return 0, fmt.Errorf("failed to get token claims")
+		return Term{}, fmt.Errorf("failed to get token claims")
+	}
+	if err := policy.Evaluate(appConfig.Authorization, claims); err != nil {
+		return Term{}, err
+	}
+	if err := policy.Evaluate(service.Authorization, claims); err != nil {
+		return Term{}, err
+	}
+	sourceNet, err := policy.SourceNetwork(claims, appConfig.Verification.SourceClaim, appConfig.Verification.RequireSourceClaim, source)
+	if err != nil {
+		return Term{}, err
 	}
 	exp, ok := claims["exp"]
 	if !ok {
-		return 0, fmt.Errorf("failed to get token exp")
+		return Term{}, fmt.Errorf("failed to get token exp")
+	}
+
+	expFloat, ok := exp.(float64)
+	if !ok {
+		return Term{}, fmt.Errorf("failed to get token exp")
 	}
 
 	now := time.Now().Unix()
-	expiration := int64(math.Min(float64(now+service.Ttl), exp.(float64)))
-	// Once everything is validated, start adding the term in a different thread
-	go r.addTerm(Term{
-		Comment:         fmt.Sprintf("jpat:%v;exp=%v", sourceAddr.IP, expiration),
-		SourceAddr:      sourceAddr.IP,
-		DestinationAddr: net.ParseIP(service.Host),
-		DestinationPort: service.Port,
-		Protocol:        service.Protocol,
-		Expiration:      expiration,
-	})
-	return expiration, nil
+	expiration := int64(math.Min(float64(now+service.Ttl), expFloat))
+	if expiration <= now {
+		return Term{}, ErrTermExpired
+	}
+	subject, _ := claims["sub"].(string)
+	term := Term{
+		ID:               newTermID(),
+		Subject:          subject,
+		SourceAddr:       source,
+		SourceNet:        sourceNet,
+		DestinationAddr:  destination,
+		DestinationPorts: service.PortRanges(),
+		Protocol:         service.Protocol,
+		Expiration:       expiration,
+	}
+	term.Comment = formatComment(term.Source(), expiration)
+	return term, nil
+}
+
+// ApplyTerm applies the term in the background and schedules its expiration
+func (r *RulesEngine) ApplyTerm(term Term) {
+	go r.addTerm(term)
 }
 
 // Given the input term, apply it and add it to the state.
 func (r *RulesEngine) addTerm(term Term) {
-	err := r.ApplyTerm(term)
+	r.setPending(term, 1)
+	defer r.setPending(term, -1)
+
+	start := time.Now()
+	err := r.backend.Apply(term)
+	metrics.FirewallApplySeconds.Observe(time.Since(start).Seconds())
 	if err != nil {
 		log.Printf("failed to apply term: %v", err)
+		return
 	}
 
-	if len(r.activeTerms) == 0 {
-		r.activeTerms = []Term{term}
+	// A duplicate, such as a retried request in the same second, shares the
+	// scheduled term's rule, so only delete the rule if the engine was closed
+	// while it was being applied
+	if err := r.scheduler.add(term); err == errSchedulerClosed {
+		r.backend.Delete(term)
 	}
-	// Iterate backwards through the terms, as new terms are more likely to
-	// have later expirations than previous terms
-	for i := 0; i < len(r.activeTerms)-1; i = i + 1 {
-		trailingIdx := len(r.activeTerms) - 1 - i
-		// If we're at the start of the list, then this needs to be the first item
-		if trailingIdx == 0 {
-			r.activeTerms = append([]Term{term}, r.activeTerms...)
-		}
-		currentTerm := r.activeTerms[trailingIdx]
-		if currentTerm.Expiration > term.Expiration {
-			firstHalf := append(r.activeTerms[:trailingIdx], term)
-			r.activeTerms = append(firstHalf, r.activeTerms[trailingIdx:]...)
+}
+
+// Count the term as being applied, or done being applied
+func (r *RulesEngine) setPending(term Term, delta int) {
+	r.pendingMu.Lock()
+	defer r.pendingMu.Unlock()
+	key := term.key()
+	if r.pending[key] += delta; r.pending[key] <= 0 {
+		delete(r.pending, key)
+	}
+}
+
+func (r *RulesEngine) isPending(term Term) bool {
+	r.pendingMu.Lock()
+	defer r.pendingMu.Unlock()
+	return r.pending[term.key()] > 0
+}
+
+// ActiveTerms returns the currently open terms, ordered by expiration
+func (r *RulesEngine) ActiveTerms() []Term {
+	return r.scheduler.list()
+}
+
+// Revoke deletes every active term matching the filter, returning the terms
+// deleted. An empty filter is an error, so a mistake can't flush every term.
+func (r *RulesEngine) Revoke(filter TermFilter) ([]Term, error) {
+	if filter.empty() {
+		return nil, errors.New("no terms selected")
+	}
+	revoked := r.scheduler.remove(filter.matches)
+	var errs []string
+	for _, term := range revoked {
+		if err := r.backend.Delete(term); err != nil {
+			errs = append(errs, err.Error())
 		}
 	}
+	if len(errs) > 0 {
+		return revoked, fmt.Errorf("failed to delete terms: %s", strings.Join(errs, "; "))
+	}
+	return revoked, nil
 }
 
-func (r *RulesEngine) Init() {
-	go r.ExpireTerms()
+// Extend the term with the ID by duration. The term is re-applied with its new
+// expiration before the old rule is deleted, so the service never closes.
+func (r *RulesEngine) Extend(id string, duration time.Duration) (Term, error) {
+	var old Term
+	found := false
+	for _, term := range r.scheduler.list() {
+		if term.ID == id {
+			old, found = term, true
+			break
+		}
+	}
+	if !found {
+		return Term{}, ErrNoSuchTerm
+	}
+
+	extended := old
+	extended.Expiration = old.Expiration + int64(duration.Seconds())
+	extended.Comment = formatComment(extended.Source(), extended.Expiration)
+	if err := r.backend.Apply(extended); err != nil {
+		return Term{}, fmt.Errorf("failed to apply extended term: %v", err)
+	}
+	// The old term may have expired while the new one was applied
+	if len(r.scheduler.remove(func(term Term) bool { return term.key() == old.key() })) == 0 {
+		r.backend.Delete(extended)
+		return Term{}, ErrNoSuchTerm
+	}
+	if err := r.scheduler.add(extended); err == errSchedulerClosed {
+		r.backend.Delete(extended)
+		return Term{}, err
+	}
+	if err := r.backend.Delete(old); err != nil {
+		log.Printf("failed to delete term %s after extending it: %v", old.Comment, err)
+	}
+	return extended, nil
 }
 
+// Stop expiring terms and delete every active term. Safe to call more than once.
 func (r *RulesEngine) Close() {
-	log.Printf("Deleting %d terms at shutdown...", len(r.activeTerms))
-	for _, term := range r.activeTerms {
-		r.DeleteTerm(term)
+	r.closeOnce.Do(func() { close(r.stopReconciler) })
+	terms := r.scheduler.close()
+	log.Printf("Deleting %d terms at shutdown...", len(terms))
+	for _, term := range terms {
+		if err := r.backend.Delete(term); err != nil {
+			log.Printf("failed to delete term: %v", err)
+		}
+	}
+	r.scheduler.saveState()
+	if err := r.backend.Close(); err != nil {
+		log.Printf("failed to close firewall backend: %v", err)
+	}
+}
+
+// Restore terms persisted by a previous run. Expired terms are deleted from the
+// backend, and the rest are re-applied and scheduled.
+func (r *RulesEngine) recover(state *stateFile) error {
+	terms, err := state.load()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	restored := 0
+	for _, term := range terms {
+		if term.Expiration <= now {
+			if err := r.backend.Delete(term); err != nil {
+				log.Printf("failed to delete expired term %s: %v", term.Comment, err)
+			}
+			continue
+		}
+		// State saved before terms had IDs
+		if term.ID == "" {
+			term.ID = newTermID()
+		}
+		r.addTerm(term)
+		restored++
+	}
+	log.Printf("Recovered %d terms from %s, deleted %d expired terms", restored, state.path, len(terms)-restored)
+
+	// Save the state even if nothing was restored, to drop the expired terms and
+	// check that the file is writable
+	return state.save(r.scheduler.list())
+}
+
+// Find terms in the backend that the scheduler doesn't know about, such as rules
+// left by a previous run. Expired terms are deleted, and the rest are adopted
+// into the scheduler so they expire on time.
+func (r *RulesEngine) Reconcile() error {
+	terms, err := r.backend.List()
+	if err != nil {
+		return err
+	}
+
+	known := make(map[string]bool)
+	for _, term := range r.scheduler.list() {
+		known[term.key()] = true
 	}
+
+	now := time.Now().Unix()
+	deleted, adopted := 0, 0
+	for _, term := range terms {
+		// Terms still being applied are scheduled once their rule is in place
+		if known[term.key()] || r.isPending(term) {
+			continue
+		}
+		if term.Expiration <= now {
+			if err := r.backend.Delete(term); err != nil {
+				log.Printf("failed to delete orphaned term %s: %v", term.Comment, err)
+				continue
+			}
+			deleted++
+			continue
+		}
+		// Terms found in the firewall don't carry an ID
+		if term.ID == "" {
+			term.ID = newTermID()
+		}
+		if r.scheduler.add(term) == nil {
+			adopted++
+		}
+	}
+	if deleted > 0 || adopted > 0 {
+		log.Printf("Reconciled firewall: deleted %d expired terms, adopted %d terms", deleted, adopted)
+	}
+	return nil
 }
 
-// Delete terms that have expired. Designed to run as a goroutine.
-// Loop indefititely with a 1-second pause between loops.
-func (r *RulesEngine) ExpireTerms() {
+// Reconcile every interval until the engine is closed. Designed to run as a goroutine.
+func (r *RulesEngine) reconcileLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	for {
-		currentTime := time.Now().Unix()
-		lastIdx := 0
-		for i, term := range r.activeTerms {
-			if currentTime < term.Expiration {
-				r.activeTerms = r.activeTerms[lastIdx:]
-				break
+		select {
+		case <-r.stopReconciler:
+			return
+		case <-ticker.C:
+			if err := r.Reconcile(); err != nil {
+				log.Printf("failed to reconcile firewall: %v", err)
 			}
-			r.DeleteTerm(term)
-			lastIdx = i
 		}
-		time.Sleep(time.Second)
 	}
 }
 
-func New() *RulesEngine {
-	return &RulesEngine{}
+// Create an engine using the backend. Terms are expired as soon as they are added.
+// If firewall.StateFile is set, active terms are persisted there, and terms left
+// by a previous run are recovered. The backend is reconciled at startup and every
+// firewall.ReconcileInterval.
+func New(backend Backend, firewall config.FirewallConfig) (*RulesEngine, error) {
+	var state *stateFile
+	if firewall.StateFile != "" {
+		state = &stateFile{path: firewall.StateFile}
+	}
+
+	engine := &RulesEngine{
+		backend:        backend,
+		scheduler:      newScheduler(backend, state),
+		stopReconciler: make(chan struct{}),
+		pending:        make(map[string]int),
+	}
+	if state != nil {
+		if err := engine.recover(state); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := engine.Reconcile(); err != nil {
+		log.Printf("failed to reconcile firewall: %v", err)
+	}
+	interval := time.Duration(firewall.ReconcileInterval)
+	if interval <= 0 {
+		interval = time.Duration(config.DEFAULT_RECONCILE_INTERVAL)
+	}
+	go engine.reconcileLoop(interval)
+	return engine, nil
 }
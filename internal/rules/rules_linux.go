@@ -4,58 +4,445 @@ package rules
 
 import (
 	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/coreos/go-iptables/iptables"
+	"github.com/micrictor/jpat/internal/config"
 )
 
 const DEFAULT_TABLE = "filter"
-const DEFAULT_CHAIN = "INPUT"
+const DEFAULT_CHAIN = "JPAT"
 const DEFAULT_ACTION = "ACCEPT"
 const DEFAULT_PROTOCOL = "tcp"
 
+// The built-in chain that jumps to the jpat chain
+const PARENT_CHAIN = "INPUT"
+const DEFAULT_JUMP_POSITION = 1
+
+// Comment identifying the trailing drop rules, which never parse as a term
+const DROP_COMMENT = COMMENT_PREFIX + "drop"
+
 var IPTV4 *iptables.IPTables
 var IPTV6 *iptables.IPTables
 
-func (r *RulesEngine) ApplyTerm(term Term) error {
-	ipt, err := getOrCreateIpt(iptables.ProtocolIPv4)
+func newPlatformBackend(appConfig *config.AppConfig) (Backend, error) {
+	firewall := appConfig.Firewall
+	switch firewall.Backend {
+	case "", config.FIREWALL_IPTABLES:
+		return newIptablesBackend(firewall, appConfig.Services)
+	case config.FIREWALL_NFTABLES:
+		return newNftablesBackend(appConfig.Services)
+	default:
+		return nil, fmt.Errorf("backend is not supported on linux")
+	}
+}
+
+// iptablesBackend keeps its rules in a dedicated chain, which PARENT_CHAIN jumps
+// to. Every rule is tagged with the term's comment, so the chain itself is the
+// record of which terms are applied. Terms are inserted at the top of the chain,
+// ahead of the optional drop rules for the protected services. IPv6 terms go
+// through ip6tables, which has its own copy of the chain.
+type iptablesBackend struct {
+	// Serializes Apply and Delete, so checking for a rule and inserting it is atomic
+	mu           sync.Mutex
+	chain        string
+	jumpPosition int
+	// The IP families the service has addresses in
+	families []iptables.Protocol
+	// Rule specs dropping traffic to protected services, if enabled
+	drops map[iptables.Protocol][][]string
+}
+
+// Create the chain and jump rule if they don't exist. An existing chain is kept,
+// so rules left by a previous run can be reconciled.
+func newIptablesBackend(firewall config.FirewallConfig, services map[string]config.ServiceConfig) (*iptablesBackend, error) {
+	b := &iptablesBackend{
+		chain:        firewall.Chain,
+		jumpPosition: firewall.JumpPosition,
+		drops:        make(map[iptables.Protocol][][]string),
+	}
+	if b.chain == "" {
+		b.chain = DEFAULT_CHAIN
+	}
+	if b.jumpPosition <= 0 {
+		b.jumpPosition = DEFAULT_JUMP_POSITION
+	}
+	// Sorted so the drops are programmed in the same order on every start
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		service := services[name]
+		if err := checkMultiport(service.PortRanges()); err != nil {
+			return nil, fmt.Errorf("service %s: %v", name, err)
+		}
+		for _, address := range service.Addresses() {
+			family := ipFamily(address)
+			if _, ok := b.drops[family]; !ok {
+				b.families = append(b.families, family)
+				b.drops[family] = nil
+			}
+			if firewall.DropUnmatched {
+				b.drops[family] = append(b.drops[family], dropRule(service, address))
+			}
+		}
+	}
+
+	for _, family := range b.families {
+		if err := b.setup(family); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Create the chain, jump and drops for a single family
+func (b *iptablesBackend) setup(family iptables.Protocol) error {
+	ipt, err := getOrCreateIpt(family)
 	if err != nil {
 		return fmt.Errorf("failed to open iptables: %v", err)
 	}
 
+	exists, err := ipt.ChainExists(DEFAULT_TABLE, b.chain)
+	if err != nil {
+		return fmt.Errorf("failed to check for chain %s: %v", b.chain, err)
+	}
+	if !exists {
+		if err := ipt.NewChain(DEFAULT_TABLE, b.chain); err != nil {
+			return fmt.Errorf("failed to create chain %s: %v", b.chain, err)
+		}
+	}
+
+	jump := b.jumpRule()
+	exists, err = ipt.Exists(DEFAULT_TABLE, PARENT_CHAIN, jump...)
+	if err != nil {
+		return fmt.Errorf("failed to check for jump to %s: %v", b.chain, err)
+	}
+	if !exists {
+		if err := ipt.Insert(DEFAULT_TABLE, PARENT_CHAIN, b.jumpPosition, jump...); err != nil {
+			return fmt.Errorf("failed to add jump to %s: %v", b.chain, err)
+		}
+	}
+
+	// Remove drops from a previous run, which may have been for other services
+	if err := b.deleteRules(ipt, func(spec []string) bool { return ruleComment(spec) == DROP_COMMENT }); err != nil {
+		return err
+	}
+	for _, drop := range b.drops[family] {
+		if err := ipt.Append(DEFAULT_TABLE, b.chain, drop...); err != nil {
+			return fmt.Errorf("failed to add drop rule: %v", err)
+		}
+	}
+	return nil
+}
+
+func (b *iptablesBackend) jumpRule() []string {
+	return []string{"--match", "comment", "--comment", COMMENT_PREFIX + "jump", "--jump", b.chain}
+}
+
+// Drop traffic to the service's address that wasn't accepted by a term
+func dropRule(service config.ServiceConfig, address net.IP) []string {
+	protocol := service.Protocol
+	if protocol == "" {
+		protocol = DEFAULT_PROTOCOL
+	}
+	spec := []string{
+		"--protocol",
+		protocol,
+		"--destination",
+		address.String(),
+	}
+	spec = append(spec, portMatch(service.PortRanges())...)
+	return append(spec,
+		"--match",
+		"comment",
+		"--comment",
+		DROP_COMMENT,
+		"--jump",
+		"DROP",
+	)
+}
+
+// Match a single port with --dport, and anything else with the multiport module
+func portMatch(ports []config.PortRange) []string {
+	if len(ports) == 1 && ports[0].From == ports[0].To {
+		return []string{"--dport", strconv.Itoa(int(ports[0].From))}
+	}
+	formatted := make([]string, len(ports))
+	for i, port := range ports {
+		formatted[i] = strconv.Itoa(int(port.From))
+		if port.From != port.To {
+			formatted[i] += ":" + strconv.Itoa(int(port.To))
+		}
+	}
+	return []string{"--match", "multiport", "--dports", strings.Join(formatted, ",")}
+}
+
+// The multiport module accepts up to MAX_MULTIPORT ports, where a range counts as two
+const MAX_MULTIPORT = 15
+
+func checkMultiport(ports []config.PortRange) error {
+	count := 0
+	for _, port := range ports {
+		count++
+		if port.From != port.To {
+			count++
+		}
+	}
+	if count > MAX_MULTIPORT {
+		return fmt.Errorf("iptables can match at most %d ports and ranges, got %s", MAX_MULTIPORT, formatPorts(ports))
+	}
+	return nil
+}
+
+// Parse the value of --dport or --dports, such as 21,30000:30100
+func parsePorts(value string) ([]config.PortRange, bool) {
+	var ports []config.PortRange
+	for _, part := range strings.Split(value, ",") {
+		port, err := config.ParsePortRange(strings.Replace(part, ":", "-", 1))
+		if err != nil {
+			return nil, false
+		}
+		ports = append(ports, port)
+	}
+	return ports, true
+}
+
+// Delete the rules in the chain matching the predicate
+func (b *iptablesBackend) deleteRules(ipt *iptables.IPTables, match func(spec []string) bool) error {
+	rules, err := ipt.List(DEFAULT_TABLE, b.chain)
+	if err != nil {
+		return fmt.Errorf("failed to list rules: %v", err)
+	}
+	for _, rule := range rules {
+		spec := splitRule(rule)
+		// iptables -S prints the -N for the chain, and each rule as -A <chain> <spec>
+		if len(spec) < 2 || spec[0] != "-A" || !match(spec) {
+			continue
+		}
+		if err := ipt.Delete(DEFAULT_TABLE, b.chain, spec[2:]...); err != nil {
+			return fmt.Errorf("failed to delete rule: %v", err)
+		}
+	}
+	return nil
+}
+
+func ruleComment(spec []string) string {
+	for i := 0; i < len(spec)-1; i++ {
+		if spec[i] == "--comment" {
+			return spec[i+1]
+		}
+	}
+	return ""
+}
+
+// Select iptables or ip6tables for the address
+func ipFamily(ip net.IP) iptables.Protocol {
+	if ip.To4() != nil {
+		return iptables.ProtocolIPv4
+	}
+	return iptables.ProtocolIPv6
+}
+
+func (b *iptablesBackend) Apply(term Term) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ipt, err := getOrCreateIpt(ipFamily(term.Source().IP))
+	if err != nil {
+		return fmt.Errorf("failed to open iptables: %v", err)
+	}
+
+	if err := checkMultiport(term.DestinationPorts); err != nil {
+		return err
+	}
 	ruleSpec := convertTerm(term)
-	err = ipt.AppendUnique(DEFAULT_TABLE, DEFAULT_CHAIN, ruleSpec...)
+	exists, err := ipt.Exists(DEFAULT_TABLE, b.chain, ruleSpec...)
+	if err != nil {
+		return fmt.Errorf("failed to check for rule: %v", err)
+	}
+	if exists {
+		return nil
+	}
+	err = ipt.Insert(DEFAULT_TABLE, b.chain, 1, ruleSpec...)
 	if err != nil {
 		return fmt.Errorf("failed to add rule: %v", err)
 	}
 	return nil
 }
 
-func (r *RulesEngine) DeleteTerm(term Term) error {
-	ipt, err := getOrCreateIpt(iptables.ProtocolIPv4)
+func (b *iptablesBackend) Delete(term Term) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ipt, err := getOrCreateIpt(ipFamily(term.Source().IP))
 	if err != nil {
 		return fmt.Errorf("failed to open iptables for delete: %v", err)
 	}
 
 	ruleSpec := convertTerm(term)
-	err = ipt.DeleteIfExists(DEFAULT_TABLE, DEFAULT_CHAIN, ruleSpec...)
+	err = ipt.DeleteIfExists(DEFAULT_TABLE, b.chain, ruleSpec...)
 	if err != nil {
 		return fmt.Errorf("failed to delete term %v", err)
 	}
 	return nil
 }
 
+// List the jpat-tagged rules in the chain of every family
+func (b *iptablesBackend) List() ([]Term, error) {
+	var terms []Term
+	for _, family := range b.families {
+		ipt, err := getOrCreateIpt(family)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open iptables for list: %v", err)
+		}
+
+		rules, err := ipt.List(DEFAULT_TABLE, b.chain)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list rules: %v", err)
+		}
+		for _, rule := range rules {
+			if term, ok := parseRule(splitRule(rule)); ok {
+				terms = append(terms, term)
+			}
+		}
+	}
+	return terms, nil
+}
+
+func (b *iptablesBackend) Flush() error {
+	terms, err := b.List()
+	if err != nil {
+		return err
+	}
+	for _, term := range terms {
+		if err := b.Delete(term); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove the jump and the chain, along with every rule in it
+func (b *iptablesBackend) Close() error {
+	for _, family := range b.families {
+		ipt, err := getOrCreateIpt(family)
+		if err != nil {
+			return fmt.Errorf("failed to open iptables for close: %v", err)
+		}
+
+		if err := ipt.DeleteIfExists(DEFAULT_TABLE, PARENT_CHAIN, b.jumpRule()...); err != nil {
+			return fmt.Errorf("failed to delete jump to %s: %v", b.chain, err)
+		}
+		if err := ipt.ClearAndDeleteChain(DEFAULT_TABLE, b.chain); err != nil {
+			return fmt.Errorf("failed to delete chain %s: %v", b.chain, err)
+		}
+	}
+	return nil
+}
+
 // Convert internal term struct into the proper rule spec for IPTables
 func convertTerm(term Term) []string {
-	return []string{
+	comment := term.Comment
+	if comment == "" {
+		comment = formatComment(term.Source(), term.Expiration)
+	}
+	spec := []string{
 		"--protocol",
 		term.Protocol,
 		"--source",
-		term.SourceAddr.String(),
+		term.Source().String(),
 		"--destination",
 		term.DestinationAddr.String(),
-		"--dport",
-		fmt.Sprintf("%d", term.DestinationPort),
 	}
+	spec = append(spec, portMatch(term.DestinationPorts)...)
+	return append(spec,
+		"--match",
+		"comment",
+		"--comment",
+		comment,
+		"--jump",
+		DEFAULT_ACTION,
+	)
+}
+
+// Convert a rule spec as printed by iptables -S back into a term. Returns false
+// for rules that weren't created by jpat.
+func parseRule(spec []string) (Term, bool) {
+	var term Term
+	for i := 0; i < len(spec)-1; i++ {
+		value := spec[i+1]
+		switch spec[i] {
+		case "-s", "--source":
+			ip, network, err := net.ParseCIDR(value)
+			if err != nil {
+				return Term{}, false
+			}
+			term.SourceAddr = ip
+			if ones, bits := network.Mask.Size(); ones != bits {
+				term.SourceNet = network
+			}
+		case "-d", "--destination":
+			ip, _, err := net.ParseCIDR(value)
+			if err != nil {
+				ip = net.ParseIP(value)
+			}
+			term.DestinationAddr = ip
+		case "-p", "--protocol":
+			term.Protocol = value
+		case "--dport", "--dports":
+			ports, ok := parsePorts(value)
+			if !ok {
+				return Term{}, false
+			}
+			term.DestinationPorts = ports
+		case "--comment":
+			term.Comment = value
+		}
+	}
+
+	expiration, ok := parseComment(term.Comment)
+	if !ok || term.SourceAddr == nil {
+		return Term{}, false
+	}
+	term.Expiration = expiration
+	return term, true
+}
+
+// Split a rule printed by iptables -S into arguments, removing the quotes
+// iptables adds around values containing spaces or quotes.
+func splitRule(rule string) []string {
+	var args []string
+	var current strings.Builder
+	inQuotes, inArg := false, false
+	for i := 0; i < len(rule); i++ {
+		c := rule[i]
+		switch {
+		case c == '\\' && inQuotes && i+1 < len(rule):
+			i++
+			current.WriteByte(rule[i])
+		case c == '"':
+			inQuotes = !inQuotes
+			inArg = true
+		case c == ' ' && !inQuotes:
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args
 }
 
 func getOrCreateIpt(protocol iptables.Protocol) (*iptables.IPTables, error) {
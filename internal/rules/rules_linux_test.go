@@ -0,0 +1,262 @@
+//go:build linux
+
+package rules
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/nftables/expr"
+	"github.com/micrictor/jpat/internal/config"
+)
+
+func TestSplitRule(t *testing.T) {
+	testCases := []struct {
+		rule     string
+		expected []string
+	}{
+		{"-A INPUT -p tcp -j ACCEPT", []string{"-A", "INPUT", "-p", "tcp", "-j", "ACCEPT"}},
+		{`-A INPUT -m comment --comment "has spaces" -j ACCEPT`, []string{"-A", "INPUT", "-m", "comment", "--comment", "has spaces", "-j", "ACCEPT"}},
+		{`--comment "escaped \"quote\""`, []string{"--comment", `escaped "quote"`}},
+		{`--comment ""`, []string{"--comment", ""}},
+	}
+	for _, tc := range testCases {
+		if args := splitRule(tc.rule); !reflect.DeepEqual(args, tc.expected) {
+			t.Errorf("splitRule(%q) = %q, expected %q", tc.rule, args, tc.expected)
+		}
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	_, network, _ := net.ParseCIDR("192.0.2.0/24")
+	testCases := []struct {
+		rule string
+		term Term
+		ok   bool
+	}{
+		{
+			`-A INPUT -s 192.0.2.1/32 -d 127.0.0.1/32 -p tcp -m tcp --dport 1337 -m comment --comment "jpat:192.0.2.1/32;exp=100" -j ACCEPT`,
+			Term{
+				Comment:          "jpat:192.0.2.1/32;exp=100",
+				SourceAddr:       net.ParseIP("192.0.2.1").To4(),
+				DestinationAddr:  net.ParseIP("127.0.0.1").To4(),
+				DestinationPorts: []config.PortRange{{From: 1337, To: 1337}},
+				Protocol:         "tcp",
+				Expiration:       100,
+			},
+			true,
+		},
+		{
+			`-A INPUT -s 192.0.2.0/24 -d 127.0.0.1/32 -p udp -m udp --dport 53 -m comment --comment jpat:192.0.2.0/24;exp=200 -j ACCEPT`,
+			Term{
+				Comment:          "jpat:192.0.2.0/24;exp=200",
+				SourceAddr:       net.ParseIP("192.0.2.0").To4(),
+				SourceNet:        network,
+				DestinationAddr:  net.ParseIP("127.0.0.1").To4(),
+				DestinationPorts: []config.PortRange{{From: 53, To: 53}},
+				Protocol:         "udp",
+				Expiration:       200,
+			},
+			true,
+		},
+		{
+			`-A JPAT -s 2001:db8::1/128 -d 2001:db8::10/128 -p tcp -m tcp --dport 22 -m comment --comment "jpat:2001:db8::1/128;exp=300" -j ACCEPT`,
+			Term{
+				Comment:          "jpat:2001:db8::1/128;exp=300",
+				SourceAddr:       net.ParseIP("2001:db8::1"),
+				DestinationAddr:  net.ParseIP("2001:db8::10"),
+				DestinationPorts: []config.PortRange{{From: 22, To: 22}},
+				Protocol:         "tcp",
+				Expiration:       300,
+			},
+			true,
+		},
+		{
+			`-A JPAT -s 192.0.2.1/32 -d 127.0.0.1/32 -p udp -m multiport --dports 21,30000:30100 -m comment --comment "jpat:192.0.2.1/32;exp=400" -j ACCEPT`,
+			Term{
+				Comment:          "jpat:192.0.2.1/32;exp=400",
+				SourceAddr:       net.ParseIP("192.0.2.1").To4(),
+				DestinationAddr:  net.ParseIP("127.0.0.1").To4(),
+				DestinationPorts: []config.PortRange{{From: 21, To: 21}, {From: 30000, To: 30100}},
+				Protocol:         "udp",
+				Expiration:       400,
+			},
+			true,
+		},
+		{"-P INPUT ACCEPT", Term{}, false},
+		{`-A INPUT -s 192.0.2.1/32 -p tcp --dport 22 -m comment --comment "ssh from office" -j ACCEPT`, Term{}, false},
+		{`-A JPAT -d 127.0.0.1/32 -p tcp -m tcp --dport 1337 -m comment --comment jpat:drop -j DROP`, Term{}, false},
+	}
+	for _, tc := range testCases {
+		term, ok := parseRule(splitRule(tc.rule))
+		if ok != tc.ok {
+			t.Errorf("parseRule(%q) ok = %v, expected %v", tc.rule, ok, tc.ok)
+			continue
+		}
+		if term.key() != tc.term.key() || term.Comment != tc.term.Comment {
+			t.Errorf("parseRule(%q) = %+v, expected %+v", tc.rule, term, tc.term)
+		}
+	}
+
+	// A parsed rule converts back to the same rule spec
+	term, _ := parseRule(splitRule(testCases[0].rule))
+	original := testCases[0].term
+	if !reflect.DeepEqual(convertTerm(term), convertTerm(original)) {
+		t.Errorf("round trip changed the rule spec: %q", convertTerm(term))
+	}
+}
+
+func TestDropRule(t *testing.T) {
+	service := config.ServiceConfig{Host: "127.0.0.1", Port: 1337}
+	expected := []string{"--protocol", "tcp", "--destination", "127.0.0.1", "--dport", "1337", "--match", "comment", "--comment", DROP_COMMENT, "--jump", "DROP"}
+	drop := dropRule(service, net.ParseIP("127.0.0.1"))
+	if !reflect.DeepEqual(drop, expected) {
+		t.Errorf("dropRule() = %q, expected %q", drop, expected)
+	}
+	if comment := ruleComment(drop); comment != DROP_COMMENT {
+		t.Errorf("ruleComment() = %q, expected %q", comment, DROP_COMMENT)
+	}
+
+	drop = dropRule(service, net.ParseIP("2001:db8::1"))
+	if drop[3] != "2001:db8::1" {
+		t.Errorf("dropRule() destination = %q, expected 2001:db8::1", drop[3])
+	}
+}
+
+func TestPortMatch(t *testing.T) {
+	testCases := []struct {
+		ports    []config.PortRange
+		expected []string
+	}{
+		{[]config.PortRange{{From: 22, To: 22}}, []string{"--dport", "22"}},
+		{[]config.PortRange{{From: 30000, To: 30100}}, []string{"--match", "multiport", "--dports", "30000:30100"}},
+		{[]config.PortRange{{From: 20, To: 21}, {From: 990, To: 990}}, []string{"--match", "multiport", "--dports", "20:21,990"}},
+	}
+	for _, tc := range testCases {
+		if match := portMatch(tc.ports); !reflect.DeepEqual(match, tc.expected) {
+			t.Errorf("portMatch(%v) = %q, expected %q", tc.ports, match, tc.expected)
+		}
+	}
+
+	var tooMany []config.PortRange
+	for i := uint16(1); i <= 8; i++ {
+		tooMany = append(tooMany, config.PortRange{From: i * 100, To: i*100 + 1})
+	}
+	if err := checkMultiport(tooMany); err == nil {
+		t.Errorf("expected an error for %d ranges", len(tooMany))
+	}
+	if err := checkMultiport(tooMany[:7]); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+// Programs the host's nftables, so only runs as root with JPAT_NFTABLES_TEST set
+func TestNftablesOverlappingSources(t *testing.T) {
+	if os.Getenv("JPAT_NFTABLES_TEST") == "" {
+		t.Skip("set JPAT_NFTABLES_TEST to program the host's nftables")
+	}
+	services := map[string]config.ServiceConfig{"test": {Host: "198.51.100.1", Port: 9, Protocol: "tcp"}}
+	n, err := newNftablesBackend(services)
+	if err != nil {
+		t.Fatalf("failed to create nftables backend: %v", err)
+	}
+	defer n.Close()
+
+	now := time.Now().Unix()
+	wide := Term{
+		SourceNet:        &net.IPNet{IP: net.ParseIP("192.0.2.0").To4(), Mask: net.CIDRMask(24, 32)},
+		DestinationAddr:  net.ParseIP("198.51.100.1"),
+		DestinationPorts: []config.PortRange{{From: 9, To: 9}},
+		Protocol:         "tcp",
+		Expiration:       now + 60,
+	}
+	// A later /32 inside the /24
+	narrow := wide
+	narrow.SourceNet = nil
+	narrow.SourceAddr = net.ParseIP("192.0.2.7").To4()
+	narrow.Expiration = now + 120
+	// Applying a term twice leaves a single active term
+	for _, term := range []Term{wide, narrow, narrow} {
+		if err := n.Apply(term); err != nil {
+			t.Fatalf("failed to apply %v: %v", term.Source(), err)
+		}
+	}
+	if active, _ := n.List(); len(active) != 2 {
+		t.Errorf("expected 2 active terms, have %d", len(active))
+	}
+
+	rules, err := n.conn.GetRule(n.table, n.chain)
+	if err != nil {
+		t.Fatalf("failed to list rules: %v", err)
+	}
+	dropped := false
+	for _, rule := range rules {
+		verdict, _ := rule.Exprs[len(rule.Exprs)-1].(*expr.Verdict)
+		if verdict.Kind == expr.VerdictDrop {
+			dropped = true
+		} else if dropped {
+			t.Errorf("accept rule %q comes after a drop", rule.UserData)
+		}
+	}
+
+	for _, term := range []Term{wide, narrow} {
+		if err := n.Delete(term); err != nil {
+			t.Errorf("failed to delete %v: %v", term.Source(), err)
+		}
+	}
+}
+
+// Programs the host's nftables, so only runs as root with JPAT_NFTABLES_TEST set
+func TestNftablesGuards(t *testing.T) {
+	if os.Getenv("JPAT_NFTABLES_TEST") == "" {
+		t.Skip("set JPAT_NFTABLES_TEST to program the host's nftables")
+	}
+	first := map[string]config.ServiceConfig{"first": {Host: "198.51.100.1", Port: 9, Protocol: "tcp"}}
+	second := map[string]config.ServiceConfig{"second": {Host: "198.51.100.2", Hosts: []string{"2001:db8::2"}, Port: 9, Protocol: "udp"}}
+
+	n, err := newNftablesBackend(first)
+	if err != nil {
+		t.Fatalf("failed to create nftables backend: %v", err)
+	}
+	term := Term{SourceAddr: net.ParseIP("192.0.2.1").To4(), DestinationAddr: net.ParseIP("198.51.100.1"), DestinationPorts: first["first"].PortRanges(), Protocol: "tcp", Expiration: time.Now().Unix() + 60}
+	if err := n.Apply(term); err != nil {
+		t.Fatalf("failed to apply: %v", err)
+	}
+	// A server restarted with other services drops their guards and sets
+	n, err = newNftablesBackend(second)
+	if err != nil {
+		t.Fatalf("failed to create nftables backend: %v", err)
+	}
+	rules, err := n.conn.GetRule(n.table, n.chain)
+	if err != nil {
+		t.Fatalf("failed to list rules: %v", err)
+	}
+	// Every address is closed before any term is applied
+	tags := make(map[string]bool)
+	for _, rule := range rules {
+		tags[string(rule.UserData)] = true
+	}
+	expected := map[string]bool{"jpat:udp/198.51.100.2/9": true, "jpat:udp/2001:db8::2/9": true}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Errorf("expected drops for the second service only, have %v", tags)
+	}
+	if sets, _ := n.conn.GetSets(n.table); len(sets) != 0 {
+		t.Errorf("expected the first service's set to be removed, have %d sets", len(sets))
+	}
+
+	if err := n.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	tables, err := n.conn.ListTables()
+	if err != nil {
+		t.Fatalf("failed to list tables: %v", err)
+	}
+	for _, table := range tables {
+		if table.Name == NFT_TABLE {
+			t.Errorf("table %s was left after close", NFT_TABLE)
+		}
+	}
+}
@@ -0,0 +1,533 @@
+package rules
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/micrictor/jpat/internal/audit"
+	"github.com/micrictor/jpat/internal/config"
+)
+
+var testService = config.ServiceConfig{
+	Name:     config.DEFAULT_SERVICE,
+	Host:     "127.0.0.1",
+	Port:     1337,
+	Protocol: "tcp",
+	Ttl:      60,
+}
+
+var testConfig = &config.AppConfig{
+	Services: map[string]config.ServiceConfig{config.DEFAULT_SERVICE: testService},
+	Verification: config.VerificationConfig{
+		SourceClaim: config.DEFAULT_SOURCE_CLAIM,
+	},
+}
+
+var testSource = &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000}
+
+func testToken(claims jwt.MapClaims) *jwt.Token {
+	return &jwt.Token{Claims: claims, Valid: true}
+}
+
+// Wait for the backend to have applied count terms, as terms are added asynchronously
+func waitForApplied(t *testing.T, backend *MemoryBackend, count int) []Term {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if applied := backend.Applied(); len(applied) >= count {
+			return applied
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d applied terms, got %d", count, len(backend.Applied()))
+	return nil
+}
+
+// Wait for the backend to have deleted count terms, as terms expire asynchronously
+func waitForDeleted(t *testing.T, backend *MemoryBackend, count int) []Term {
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if deleted := backend.Deleted(); len(deleted) >= count {
+			return deleted
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d deleted terms, got %d", count, len(backend.Deleted()))
+	return nil
+}
+
+func TestNewTerm(t *testing.T) {
+	backend := NewMemoryBackend()
+	engine, _ := New(backend, config.FirewallConfig{})
+	defer engine.Close()
+
+	exp := time.Now().Add(time.Hour).Unix()
+	built, err := engine.NewTerm(testSource.IP, testToken(jwt.MapClaims{"exp": float64(exp)}), testService, testConfig)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	engine.ApplyTerm(built)
+	expiration := built.Expiration
+	// The service TTL is shorter than the token's exp
+	if expiration > time.Now().Unix()+testService.Ttl {
+		t.Errorf("expiration %d exceeds service ttl", expiration)
+	}
+
+	applied := waitForApplied(t, backend, 1)
+	term := applied[0]
+	if !term.SourceAddr.Equal(testSource.IP) || term.Source().String() != "192.0.2.1/32" {
+		t.Errorf("term source %v does not match %v", term.Source(), testSource.IP)
+	}
+	if !term.DestinationAddr.Equal(net.ParseIP("127.0.0.1")) || formatPorts(term.DestinationPorts) != "1337" || term.Protocol != "tcp" {
+		t.Errorf("term destination %v:%s/%s does not match service", term.DestinationAddr, formatPorts(term.DestinationPorts), term.Protocol)
+	}
+	if term.Expiration != expiration {
+		t.Errorf("applied expiration %d does not match built expiration %d", term.Expiration, expiration)
+	}
+}
+
+func TestNewTermIPv6(t *testing.T) {
+	dualStackService := testService
+	dualStackService.Hosts = []string{"::1"}
+	exp := float64(time.Now().Add(time.Hour).Unix())
+
+	testCases := []struct {
+		source      string
+		destination string
+	}{
+		{"2001:db8::1", "::1"},
+		{"::ffff:192.0.2.1", "127.0.0.1"},
+	}
+	for _, tc := range testCases {
+		backend := NewMemoryBackend()
+		engine, _ := New(backend, config.FirewallConfig{})
+		defer engine.Close()
+
+		source := &net.UDPAddr{IP: net.ParseIP(tc.source), Port: 5000}
+		built, err := engine.NewTerm(source.IP, testToken(jwt.MapClaims{"exp": exp}), dualStackService, testConfig)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tc.source, err)
+		}
+		engine.ApplyTerm(built)
+		term := waitForApplied(t, backend, 1)[0]
+		if !term.DestinationAddr.Equal(net.ParseIP(tc.destination)) {
+			t.Errorf("%s: term destination %v, expected %s", tc.source, term.DestinationAddr, tc.destination)
+		}
+		if !term.Source().IP.Equal(source.IP) {
+			t.Errorf("%s: term source %v does not match", tc.source, term.Source())
+		}
+	}
+
+	// An IPv4-only service can't be opened for an IPv6 source
+	engine, _ := New(NewMemoryBackend(), config.FirewallConfig{})
+	defer engine.Close()
+	source := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5000}
+	if _, err := engine.NewTerm(source.IP, testToken(jwt.MapClaims{"exp": exp}), testService, testConfig); err == nil {
+		t.Errorf("expected error for IPv6 source")
+	}
+}
+
+func TestNewTermRejects(t *testing.T) {
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	authorizedConfig := *testConfig
+	authorizedConfig.Authorization = config.AuthorizationConfig{
+		Require: []config.ClaimRule{{Claim: "sub", Prefix: "employee:"}},
+	}
+	authorizedService := testService
+	authorizedService.Authorization = config.AuthorizationConfig{
+		Deny: []config.ClaimRule{{Claim: "sub", Equals: "employee:2"}},
+	}
+
+	testCases := []struct {
+		name      string
+		token     *jwt.Token
+		service   config.ServiceConfig
+		appConfig *config.AppConfig
+	}{
+		{"invalid token", &jwt.Token{Claims: jwt.MapClaims{"exp": exp}}, testService, testConfig},
+		{"missing exp", testToken(jwt.MapClaims{}), testService, testConfig},
+		{"policy denied", testToken(jwt.MapClaims{"exp": exp, "sub": "machine:1"}), testService, &authorizedConfig},
+		{"service policy denied", testToken(jwt.MapClaims{"exp": exp, "sub": "employee:2"}), authorizedService, &authorizedConfig},
+		{"source not in cidr", testToken(jwt.MapClaims{"exp": exp, "cidr": "198.51.100.0/24"}), testService, testConfig},
+	}
+	engine, _ := New(NewMemoryBackend(), config.FirewallConfig{})
+	defer engine.Close()
+	for _, tc := range testCases {
+		if _, err := engine.NewTerm(testSource.IP, tc.token, tc.service, tc.appConfig); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+}
+
+func TestNewTermExpiredWithinLeeway(t *testing.T) {
+	now := time.Now().Unix()
+	testCases := []struct {
+		name string
+		exp  int64
+		err  error
+	}{
+		{"expired", now - 5, ErrTermExpired},
+		{"expires now", now, ErrTermExpired},
+		{"expires later", now + 60, nil},
+	}
+	engine, _ := New(NewMemoryBackend(), config.FirewallConfig{})
+	defer engine.Close()
+	for _, tc := range testCases {
+		term, err := engine.NewTerm(testSource.IP, testToken(jwt.MapClaims{"exp": float64(tc.exp)}), testService, testConfig)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+		if err == nil && term.Expiration <= time.Now().Unix() {
+			t.Errorf("%s: term expiration %d has already passed", tc.name, term.Expiration)
+		}
+	}
+}
+
+func TestAddTermSchedulesExpiration(t *testing.T) {
+	backend := NewMemoryBackend()
+	engine, _ := New(backend, config.FirewallConfig{})
+	defer engine.Close()
+
+	now := time.Now().Unix()
+	engine.addTerm(Term{SourceAddr: testSource.IP, Expiration: now + 3600})
+	engine.addTerm(Term{SourceAddr: testSource.IP, Expiration: now - 1})
+
+	waitForDeleted(t, backend, 1)
+	active := engine.ActiveTerms()
+	if len(active) != 1 || active[0].Expiration != now+3600 {
+		t.Errorf("expected only the unexpired term to remain, got %v", active)
+	}
+}
+
+// Calls afterApply once each term's rule is in place
+type hookBackend struct {
+	*MemoryBackend
+	afterApply func()
+}
+
+func (h *hookBackend) Apply(term Term) error {
+	err := h.MemoryBackend.Apply(term)
+	h.afterApply()
+	return err
+}
+
+func TestAddTermDuplicate(t *testing.T) {
+	backend := NewMemoryBackend()
+	engine, _ := New(backend, config.FirewallConfig{})
+	defer engine.Close()
+
+	// A retried request in the same second produces a term with the same key
+	term := Term{ID: "a", SourceAddr: testSource.IP, Expiration: time.Now().Unix() + 3600}
+	engine.addTerm(term)
+	term.ID = "b"
+	engine.addTerm(term)
+
+	if applied := backend.Applied(); len(applied) != 2 {
+		t.Errorf("expected 2 applies, got %d", len(applied))
+	}
+	if deleted := backend.Deleted(); len(deleted) != 0 {
+		t.Errorf("duplicate term deleted the active rule: %v", deleted)
+	}
+	if active, _ := backend.List(); len(active) != 1 {
+		t.Errorf("expected 1 rule, got %v", active)
+	}
+	if scheduled := engine.ActiveTerms(); len(scheduled) != 1 || scheduled[0].ID != "a" {
+		t.Errorf("expected the first term to stay scheduled, got %v", scheduled)
+	}
+}
+
+func TestReconcileSkipsPendingTerms(t *testing.T) {
+	backend := &hookBackend{MemoryBackend: NewMemoryBackend(), afterApply: func() {}}
+	engine, _ := New(backend, config.FirewallConfig{})
+	defer engine.Close()
+
+	// Reconcile between the term's rule being applied and it being scheduled
+	backend.afterApply = func() { engine.Reconcile() }
+	term := Term{ID: "a", Subject: "alice", SourceAddr: testSource.IP, Expiration: time.Now().Unix() + 3600}
+	term.Comment = formatComment(term.Source(), term.Expiration)
+	engine.addTerm(term)
+
+	scheduled := engine.ActiveTerms()
+	if len(scheduled) != 1 || scheduled[0].ID != "a" || scheduled[0].Subject != "alice" {
+		t.Errorf("reconciler adopted the term being applied: %v", scheduled)
+	}
+	if deleted := backend.Deleted(); len(deleted) != 0 {
+		t.Errorf("term was deleted: %v", deleted)
+	}
+}
+
+func TestClose(t *testing.T) {
+	backend := NewMemoryBackend()
+	engine, _ := New(backend, config.FirewallConfig{})
+
+	now := time.Now().Unix()
+	for i := int64(0); i < 3; i++ {
+		engine.addTerm(Term{SourceAddr: testSource.IP, Expiration: now + 3600 + i})
+	}
+	engine.Close()
+	engine.Close()
+
+	if deleted := backend.Deleted(); len(deleted) != 3 {
+		t.Errorf("expected 3 terms deleted at close, got %d", len(deleted))
+	}
+	if active, _ := backend.List(); len(active) != 0 {
+		t.Errorf("backend still has %d active terms", len(active))
+	}
+
+	// Terms added after close are not left behind
+	engine.addTerm(Term{SourceAddr: testSource.IP, Expiration: now + 3600})
+	if active, _ := backend.List(); len(active) != 0 {
+		t.Errorf("term added after close is still active")
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	now := time.Now().Unix()
+	terms := []Term{
+		{ID: "a", Subject: "alice", SourceAddr: testSource.IP, Expiration: now + 3600},
+		{ID: "b", Subject: "bob", SourceAddr: testSource.IP, Expiration: now + 3601},
+		{ID: "c", Subject: "alice", SourceAddr: net.ParseIP("198.51.100.1"), Expiration: now + 3602},
+	}
+	tests := []struct {
+		name    string
+		filter  TermFilter
+		revoked []string
+	}{
+		{"id", TermFilter{ID: "b"}, []string{"b"}},
+		{"subject", TermFilter{Subject: "alice"}, []string{"a", "c"}},
+		{"source", TermFilter{Source: testSource.IP}, []string{"a", "b"}},
+		{"subject and source", TermFilter{Subject: "alice", Source: testSource.IP}, []string{"a"}},
+		{"all", TermFilter{All: true}, []string{"a", "b", "c"}},
+		{"no match", TermFilter{ID: "d"}, nil},
+	}
+	for _, tc := range tests {
+		backend := NewMemoryBackend()
+		engine, _ := New(backend, config.FirewallConfig{})
+		for _, term := range terms {
+			engine.addTerm(term)
+		}
+
+		revoked, err := engine.Revoke(tc.filter)
+		if err != nil {
+			t.Errorf("%s: failed to revoke: %v", tc.name, err)
+		}
+		var ids []string
+		for _, term := range revoked {
+			ids = append(ids, term.ID)
+		}
+		if strings.Join(ids, ",") != strings.Join(tc.revoked, ",") {
+			t.Errorf("%s: revoked %v, expected %v", tc.name, ids, tc.revoked)
+		}
+		if deleted := backend.Deleted(); len(deleted) != len(tc.revoked) {
+			t.Errorf("%s: deleted %d terms, expected %d", tc.name, len(deleted), len(tc.revoked))
+		}
+		if active := engine.ActiveTerms(); len(active) != len(terms)-len(tc.revoked) {
+			t.Errorf("%s: %d terms still active", tc.name, len(active))
+		}
+		engine.Close()
+	}
+
+	engine, _ := New(NewMemoryBackend(), config.FirewallConfig{})
+	defer engine.Close()
+	if _, err := engine.Revoke(TermFilter{}); err == nil {
+		t.Errorf("an empty filter was accepted")
+	}
+}
+
+func TestExtend(t *testing.T) {
+	backend := NewMemoryBackend()
+	engine, _ := New(backend, config.FirewallConfig{})
+	defer engine.Close()
+
+	now := time.Now().Unix()
+	term := Term{ID: "a", SourceAddr: testSource.IP, Expiration: now + 60}
+	term.Comment = formatComment(term.Source(), term.Expiration)
+	engine.addTerm(term)
+
+	extended, err := engine.Extend("a", time.Minute)
+	if err != nil {
+		t.Fatalf("failed to extend term: %v", err)
+	}
+	if extended.ID != "a" || extended.Expiration != now+120 {
+		t.Errorf("unexpected extended term %+v", extended)
+	}
+	if active := engine.ActiveTerms(); len(active) != 1 || active[0].Expiration != now+120 {
+		t.Errorf("unexpected active terms %v", active)
+	}
+	// The extended rule is applied before the old one is deleted
+	if applied := backend.Applied(); len(applied) != 2 || applied[1].Expiration != now+120 {
+		t.Errorf("extended term was not applied: %v", applied)
+	}
+	if deleted := backend.Deleted(); len(deleted) != 1 || deleted[0].Expiration != now+60 {
+		t.Errorf("old term was not deleted: %v", deleted)
+	}
+	if listed, _ := backend.List(); len(listed) != 1 || listed[0].Expiration != now+120 {
+		t.Errorf("unexpected firewall terms %v", listed)
+	}
+
+	if _, err := engine.Extend("b", time.Minute); err != ErrNoSuchTerm {
+		t.Errorf("expected ErrNoSuchTerm, got %v", err)
+	}
+}
+
+func TestAuditedBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	logger, err := audit.New([]config.AuditSinkConfig{{Type: config.AUDIT_SINK_FILE, Path: path}})
+	if err != nil {
+		t.Fatalf("failed to create audit log: %v", err)
+	}
+	engine, _ := New(NewAuditedBackend(NewMemoryBackend(), logger), config.FirewallConfig{})
+
+	term := Term{SourceAddr: testSource.IP, Expiration: time.Now().Unix() + 3600}
+	term.Comment = formatComment(term.Source(), term.Expiration)
+	engine.addTerm(term)
+	engine.Close()
+	logger.Close()
+
+	data, _ := os.ReadFile(path)
+	for _, event := range []string{audit.EVENT_TERM_APPLIED, audit.EVENT_TERM_DELETED} {
+		if !strings.Contains(string(data), `"event":"`+event+`","source":"192.0.2.1/32"`) {
+			t.Errorf("no %s record in %s", event, data)
+		}
+	}
+}
+
+func TestStatePersistedAndRecovered(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	now := time.Now().Unix()
+
+	engine, err := New(NewMemoryBackend(), config.FirewallConfig{StateFile: statePath})
+	if err != nil {
+		t.Fatalf("failed to create engine: %v", err)
+	}
+	engine.addTerm(Term{SourceAddr: net.ParseIP("192.0.2.1"), DestinationPorts: testService.PortRanges(), Expiration: now + 3600})
+	engine.addTerm(Term{SourceAddr: net.ParseIP("192.0.2.2"), DestinationPorts: testService.PortRanges(), Expiration: now + 3601})
+
+	// Simulate a crash by abandoning the engine without closing it, then
+	// expire one of the terms before the restart
+	state := &stateFile{path: statePath}
+	terms, err := state.load()
+	if err != nil || len(terms) != 2 {
+		t.Fatalf("expected 2 persisted terms, got %v: %v", terms, err)
+	}
+	terms[0].Expiration = now - 1
+	if err := state.save(terms); err != nil {
+		t.Fatalf("failed to save state: %v", err)
+	}
+
+	backend := NewMemoryBackend()
+	recovered, err := New(backend, config.FirewallConfig{StateFile: statePath})
+	if err != nil {
+		t.Fatalf("failed to recover engine: %v", err)
+	}
+	defer recovered.Close()
+
+	if deleted := backend.Deleted(); len(deleted) != 1 || !deleted[0].SourceAddr.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("expected the expired term to be deleted, got %v", deleted)
+	}
+	active := recovered.ActiveTerms()
+	if len(active) != 1 || !active[0].SourceAddr.Equal(net.ParseIP("192.0.2.2")) {
+		t.Errorf("expected the unexpired term to be rescheduled, got %v", active)
+	}
+	if applied := backend.Applied(); len(applied) != 1 {
+		t.Errorf("expected the unexpired term to be re-applied, got %v", applied)
+	}
+	if terms, _ := state.load(); len(terms) != 1 {
+		t.Errorf("expected the expired term to be dropped from the state file, got %v", terms)
+	}
+
+	recovered.Close()
+	if terms, _ := state.load(); len(terms) != 0 {
+		t.Errorf("expected an empty state file after close, got %v", terms)
+	}
+}
+
+func TestStateLegacyPorts(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	legacy := `[
+		{"ID": "a", "SourceAddr": "192.0.2.1", "DestinationAddr": "127.0.0.1", "DestinationPort": 22, "Protocol": "tcp", "Expiration": 1},
+		{"ID": "b", "SourceAddr": "192.0.2.2", "DestinationAddr": "127.0.0.1", "Protocol": "tcp", "Expiration": 1}
+	]`
+	if err := os.WriteFile(statePath, []byte(legacy), 0600); err != nil {
+		t.Fatalf("failed to write state: %v", err)
+	}
+
+	terms, err := (&stateFile{path: statePath}).load()
+	if err != nil {
+		t.Fatalf("failed to load state: %v", err)
+	}
+	// The term with no port at all is dropped rather than opening every port
+	if len(terms) != 1 || terms[0].ID != "a" || formatPorts(terms[0].DestinationPorts) != "22" {
+		t.Errorf("expected the legacy port to be read, got %v", terms)
+	}
+}
+
+func TestStateUnwritable(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "missing", "state.json")
+	if _, err := New(NewMemoryBackend(), config.FirewallConfig{StateFile: statePath}); err == nil {
+		t.Errorf("expected an error for an unwritable state file")
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	now := time.Now().Unix()
+	orphanExpired := Term{SourceAddr: net.ParseIP("192.0.2.1"), Expiration: now - 1}
+	orphanActive := Term{SourceAddr: net.ParseIP("192.0.2.2"), Expiration: now + 3600}
+
+	// Rules left in the firewall by a previous run
+	backend := NewMemoryBackend()
+	backend.Apply(orphanExpired)
+	backend.Apply(orphanActive)
+
+	engine, err := New(backend, config.FirewallConfig{})
+	if err != nil {
+		t.Fatalf("failed to create engine: %v", err)
+	}
+	defer engine.Close()
+
+	if deleted := backend.Deleted(); len(deleted) != 1 || deleted[0].key() != orphanExpired.key() {
+		t.Errorf("expected the expired orphan to be deleted, got %v", deleted)
+	}
+	if active := engine.ActiveTerms(); len(active) != 1 || active[0].key() != orphanActive.key() {
+		t.Errorf("expected the active orphan to be adopted, got %v", active)
+	}
+
+	// Reconciling again changes nothing
+	if err := engine.Reconcile(); err != nil {
+		t.Fatalf("failed to reconcile: %v", err)
+	}
+	if active := engine.ActiveTerms(); len(active) != 1 {
+		t.Errorf("expected 1 active term after reconciling again, got %d", len(active))
+	}
+}
+
+func TestParseComment(t *testing.T) {
+	_, network, _ := net.ParseCIDR("192.0.2.0/24")
+	comment := formatComment(network, 1640847207)
+	if comment != "jpat:192.0.2.0/24;exp=1640847207" {
+		t.Errorf("unexpected comment %s", comment)
+	}
+
+	testCases := []struct {
+		comment    string
+		expiration int64
+		ok         bool
+	}{
+		{comment, 1640847207, true},
+		{"jpat:2001:db8::1/128;exp=5", 5, true},
+		{"operator rule", 0, false},
+		{"jpat:192.0.2.1/32", 0, false},
+		{"jpat:192.0.2.1/32;exp=soon", 0, false},
+	}
+	for _, tc := range testCases {
+		expiration, ok := parseComment(tc.comment)
+		if ok != tc.ok || expiration != tc.expiration {
+			t.Errorf("parseComment(%q) = %d, %v; expected %d, %v", tc.comment, expiration, ok, tc.expiration, tc.ok)
+		}
+	}
+}
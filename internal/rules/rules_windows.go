@@ -5,39 +5,109 @@ package rules
 import (
 	"fmt"
 	"log"
-	"time"
+	"sync"
 
+	"github.com/micrictor/jpat/internal/config"
 	"golang.org/x/sys/windows"
 	"inet.af/netaddr"
 	"inet.af/wf"
 )
 
-func (r *RulesEngine) ApplyTerm(term Term) error {
+func newPlatformBackend(appConfig *config.AppConfig) (Backend, error) {
+	switch appConfig.Firewall.Backend {
+	case "", config.FIREWALL_WFP:
+		return newWfpBackend()
+	default:
+		return nil, fmt.Errorf("backend is not supported on windows")
+	}
+}
+
+// wfpBackend adds a Windows Filtering Platform rule for each term. The session is
+// dynamic, so Windows removes every rule when the server exits.
+type wfpBackend struct {
+	mu      sync.Mutex
+	session *wf.Session
+	ruleIDs map[string]wf.RuleID
+	active  []Term
+}
+
+func newWfpBackend() (*wfpBackend, error) {
 	session, err := wf.New(&wf.Options{
 		Name:        "jpat",
 		Description: "JPAT SPA",
 		Dynamic:     true,
 	})
 	if err != nil {
-		return fmt.Errorf("creating wf session: %v", err)
+		return nil, fmt.Errorf("creating wf session: %v", err)
+	}
+	return &wfpBackend{
+		session: session,
+		ruleIDs: make(map[string]wf.RuleID),
+	}, nil
+}
+
+func (b *wfpBackend) Apply(term Term) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Delete only removes the rule recorded for the key, so keep a single one
+	if _, ok := b.ruleIDs[term.key()]; ok {
+		return nil
+	}
+	wfRule := convertTerm(term)
+	if err := b.session.AddRule(&wfRule); err != nil {
+		return err
 	}
+	b.ruleIDs[term.key()] = wfRule.ID
+	b.active = append(b.active, term)
+	return nil
+}
 
-	rules, _ := session.Rules()
+func (b *wfpBackend) Delete(term Term) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-	for _, r := range rules {
-		if r.Name == "ACANARYNAME" {
-			log.Printf("%v", r)
+	ruleID, ok := b.ruleIDs[term.key()]
+	if !ok {
+		return nil
+	}
+	log.Printf("Deleting rule for %v as it has expired.", term.Source())
+	if err := b.session.DeleteRule(ruleID); err != nil {
+		return fmt.Errorf("error deleting rule: %v", err)
+	}
+	delete(b.ruleIDs, term.key())
+	for i, active := range b.active {
+		if active.key() == term.key() {
+			b.active = append(b.active[:i], b.active[i+1:]...)
+			break
 		}
 	}
+	return nil
+}
 
-	wfRule := convertTerm(term)
+func (b *wfpBackend) List() ([]Term, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Term{}, b.active...), nil
+}
 
-	if err := session.AddRule(&wfRule); err != nil {
-		return err
+func (b *wfpBackend) Flush() error {
+	terms, _ := b.List()
+	for _, term := range terms {
+		if err := b.Delete(term); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// Closing the dynamic session removes every rule it added
+func (b *wfpBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.session.Close()
+}
+
 func convertTerm(term Term) wf.Rule {
 	ruleGuid, err := windows.GenerateGUID()
 	if err != nil {
@@ -45,54 +115,46 @@ func convertTerm(term Term) wf.Rule {
 		return wf.Rule{}
 	}
 
-	convertedSource, _ := netaddr.FromStdIP(term.SourceAddr)
+	convertedSource, _ := netaddr.FromStdIPNet(term.Source())
 	sublayer, _ := windows.GUIDFromString("{B3CDD441-AF90-41BA-A745-7C6008FF2301}")
+	layer := wf.LayerALEAuthRecvAcceptV4
+	if term.Source().IP.To4() == nil {
+		layer = wf.LayerALEAuthRecvAcceptV6
+	}
+
+	// WFP ORs conditions on the same field, so the term matches any of its ports
+	conditions := []*wf.Match{
+		&wf.Match{
+			Field: wf.FieldIPRemoteAddress,
+			Op:    wf.MatchTypeEqual,
+			Value: convertedSource,
+		},
+	}
+	for _, port := range term.DestinationPorts {
+		if port.From == port.To {
+			conditions = append(conditions, &wf.Match{
+				Field: wf.FieldIPLocalPort,
+				Op:    wf.MatchTypeEqual,
+				Value: port.From,
+			})
+			continue
+		}
+		conditions = append(conditions, &wf.Match{
+			Field: wf.FieldIPLocalPort,
+			Op:    wf.MatchTypeRange,
+			Value: wf.Range{From: port.From, To: port.To},
+		})
+	}
 
 	return wf.Rule{
 		ID:          wf.RuleID(ruleGuid),
 		KernelID:    4,
-		Name:        fmt.Sprintf("JPAT Rule for %s", term.SourceAddr.String()),
+		Name:        fmt.Sprintf("JPAT Rule for %s", term.Source().String()),
 		Description: fmt.Sprintf("JPAT: %v", term.Comment),
-		Layer:       wf.LayerALEAuthRecvAcceptV4,
+		Layer:       layer,
 		Sublayer:    wf.SublayerID(sublayer),
 		Weight:      1,
 		Action:      wf.ActionPermit,
-		Conditions: []*wf.Match{
-			&wf.Match{
-				Field: wf.FieldIPRemoteAddress,
-				Op:    wf.MatchTypeEqual,
-				Value: convertedSource,
-			},
-			&wf.Match{
-				Field: wf.FieldIPLocalPort,
-				Op:    wf.MatchTypeEqual,
-				Value: term.DestinationPort,
-			},
-		},
-	}
-}
-
-// This is ran as a goroutine, sleeping for the time delta between the current time and the
-// expiration time before deleting the rule from the IPTable.
-// This won't scale up well - having N goroutines for N active rules is a lot of overhead.
-// Would likely best be some sort of async worker, either a goroutine or a dedicated thread,
-// with a shared context of the list of active rules to check for expiration at a desired
-// resolution - once every 30 seconds, once per minute, etc
-func scheduleRuleDeletion(rule Rule, wfpRuleId wf.RuleID) {
-	timeDelay := rule.Expiration - uint64(time.Now().Unix())
-	time.Sleep(time.Duration(timeDelay * 10e8))
-
-	session, err := wf.New(&wf.Options{
-		Name:        "jpat",
-		Description: "JPAT SPA",
-		Dynamic:     true,
-	})
-	if err != nil {
-		log.Printf("error creating wf session for rule deletion: %v", err)
-	}
-
-	log.Printf("Deleting rule %v as it has expired.", rule)
-	if err := session.DeleteRule(wfpRuleId); err != nil {
-		log.Printf("error deleting rule: %v", err)
+		Conditions:  conditions,
 	}
 }
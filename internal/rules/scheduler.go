@@ -0,0 +1,177 @@
+package rules
+
+import (
+	"container/heap"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Min-heap of terms ordered by expiration
+type termHeap []Term
+
+func (h termHeap) Len() int            { return len(h) }
+func (h termHeap) Less(i, j int) bool  { return h[i].Expiration < h[j].Expiration }
+func (h termHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *termHeap) Push(x interface{}) { *h = append(*h, x.(Term)) }
+func (h *termHeap) Pop() interface{} {
+	old := *h
+	term := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return term
+}
+
+var errSchedulerClosed = errors.New("the engine is closed")
+
+// Returned when the scheduler already tracks a term with the same key. The
+// term's rule is already in the firewall, so it must not be deleted.
+var errDuplicateTerm = errors.New("term is already active")
+
+// scheduler tracks active terms and deletes each one from the backend once it
+// expires. A single timer is armed for the earliest expiration.
+type scheduler struct {
+	backend Backend
+	// If set, the active terms are saved on every change
+	state *stateFile
+
+	mu     sync.Mutex
+	terms  termHeap
+	timer  *time.Timer
+	closed bool
+}
+
+func newScheduler(backend Backend, state *stateFile) *scheduler {
+	return &scheduler{backend: backend, state: state}
+}
+
+// Track the term until it expires. Returns errSchedulerClosed if the scheduler
+// is closed, or errDuplicateTerm if it is already tracking the term.
+func (s *scheduler) add(term Term) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errSchedulerClosed
+	}
+	for _, existing := range s.terms {
+		if existing.key() == term.key() {
+			return errDuplicateTerm
+		}
+	}
+
+	heap.Push(&s.terms, term)
+	s.resetTimer()
+	s.save()
+	return nil
+}
+
+// Stop tracking every term matching match, returning the terms removed
+func (s *scheduler) remove(match func(Term) bool) []Term {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var removed []Term
+	kept := s.terms[:0]
+	for _, term := range s.terms {
+		if match(term) {
+			removed = append(removed, term)
+		} else {
+			kept = append(kept, term)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	s.terms = kept
+	heap.Init(&s.terms)
+	s.resetTimer()
+	s.save()
+	return removed
+}
+
+// Return the active terms, ordered by expiration
+func (s *scheduler) list() []Term {
+	s.mu.Lock()
+	sorted := append(termHeap{}, s.terms...)
+	s.mu.Unlock()
+
+	terms := make([]Term, 0, len(sorted))
+	for sorted.Len() > 0 {
+		terms = append(terms, heap.Pop(&sorted).(Term))
+	}
+	return terms
+}
+
+// Stop the timer and return every term that was still active
+func (s *scheduler) close() []Term {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	terms := s.terms
+	s.terms = nil
+	return terms
+}
+
+// Persist the active terms
+func (s *scheduler) saveState() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.save()
+}
+
+// Must be called with the lock held.
+func (s *scheduler) save() {
+	if s.state == nil {
+		return
+	}
+	if err := s.state.save(s.terms); err != nil {
+		log.Printf("failed to save term state: %v", err)
+	}
+}
+
+// Arm the timer for the earliest expiration. Must be called with the lock held.
+func (s *scheduler) resetTimer() {
+	if len(s.terms) == 0 {
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+		return
+	}
+
+	delay := time.Until(time.Unix(s.terms[0].Expiration, 0))
+	if s.timer == nil {
+		s.timer = time.AfterFunc(delay, s.expire)
+	} else {
+		s.timer.Reset(delay)
+	}
+}
+
+// Timer callback which deletes every expired term, then re-arms the timer.
+func (s *scheduler) expire() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	now := time.Now().Unix()
+	var expired []Term
+	for len(s.terms) > 0 && s.terms[0].Expiration <= now {
+		expired = append(expired, heap.Pop(&s.terms).(Term))
+	}
+	s.resetTimer()
+	if len(expired) > 0 {
+		s.save()
+	}
+	s.mu.Unlock()
+
+	// Backend calls can be slow, so make them without holding the lock
+	for _, term := range expired {
+		if err := s.backend.Delete(term); err != nil {
+			log.Printf("failed to delete expired term: %v", err)
+		}
+	}
+}
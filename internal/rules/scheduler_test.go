@@ -0,0 +1,101 @@
+package rules
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSchedulerListOrdered(t *testing.T) {
+	s := newScheduler(NewMemoryBackend(), nil)
+	defer s.close()
+
+	now := time.Now().Unix()
+	for i, offset := range []int64{30, 10, 20, 40, 10, 5} {
+		s.add(Term{SourceAddr: net.IPv4(192, 0, 2, byte(i)), Expiration: now + 3600 + offset})
+	}
+
+	expected := []int64{5, 10, 10, 20, 30, 40}
+	terms := s.list()
+	if len(terms) != len(expected) {
+		t.Fatalf("expected %d terms, got %d", len(expected), len(terms))
+	}
+	for i, term := range terms {
+		if term.Expiration != now+3600+expected[i] {
+			t.Errorf("term %d has expiration offset %d, expected %d", i, term.Expiration-now-3600, expected[i])
+		}
+	}
+}
+
+func TestSchedulerIgnoresDuplicates(t *testing.T) {
+	s := newScheduler(NewMemoryBackend(), nil)
+	defer s.close()
+
+	term := Term{SourceAddr: testSource.IP, Expiration: time.Now().Unix() + 3600}
+	if err := s.add(term); err != nil {
+		t.Errorf("first add was rejected: %v", err)
+	}
+	if err := s.add(term); err != errDuplicateTerm {
+		t.Errorf("duplicate add returned %v", err)
+	}
+	if terms := s.list(); len(terms) != 1 {
+		t.Errorf("expected 1 term, got %d", len(terms))
+	}
+	s.close()
+	if err := s.add(Term{SourceAddr: testSource.IP, Expiration: term.Expiration + 1}); err != errSchedulerClosed {
+		t.Errorf("add after close returned %v", err)
+	}
+}
+
+func TestSchedulerExpiresInOrder(t *testing.T) {
+	backend := NewMemoryBackend()
+	s := newScheduler(backend, nil)
+	defer s.close()
+
+	now := time.Now().Unix()
+	s.add(Term{SourceAddr: testSource.IP, Expiration: now + 3600})
+	s.add(Term{SourceAddr: testSource.IP, Expiration: now + 1})
+	s.add(Term{SourceAddr: testSource.IP, Expiration: now - 1})
+
+	deleted := waitForDeleted(t, backend, 2)
+	if deleted[0].Expiration != now-1 || deleted[1].Expiration != now+1 {
+		t.Errorf("terms expired out of order: %v", deleted)
+	}
+	if remaining := s.list(); len(remaining) != 1 || remaining[0].Expiration != now+3600 {
+		t.Errorf("expected only the latest term to remain, got %v", remaining)
+	}
+}
+
+// Run with -race to check that concurrent adds, lists and expirations are safe
+func TestSchedulerConcurrent(t *testing.T) {
+	backend := NewMemoryBackend()
+	s := newScheduler(backend, nil)
+	defer s.close()
+
+	now := time.Now().Unix()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			term := Term{SourceAddr: net.IPv4(192, 0, 2, byte(i)), Expiration: now - 1}
+			// Half of the terms stay active
+			if i%2 == 0 {
+				term.Expiration = now + 3600
+			}
+			backend.Apply(term)
+			s.add(term)
+			s.list()
+		}(i)
+	}
+	wg.Wait()
+
+	waitForDeleted(t, backend, 25)
+	if remaining := s.list(); len(remaining) != 25 {
+		t.Errorf("expected 25 active terms, got %d", len(remaining))
+	}
+	if active, _ := backend.List(); len(active) != 25 {
+		t.Errorf("expected 25 terms in the backend, got %d", len(active))
+	}
+}
@@ -0,0 +1,81 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/micrictor/jpat/internal/config"
+)
+
+// stateFile persists the active terms, so terms left behind by a crash can be
+// cleaned up when the server restarts.
+type stateFile struct {
+	path string
+}
+
+// Replace the file contents with terms. The file is written to a temporary path
+// and renamed, so a crash never leaves it half written.
+func (f *stateFile) save(terms []Term) error {
+	data, err := json.Marshal(terms)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create state file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync state file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// Read the persisted terms. A missing file holds no terms.
+func (f *stateFile) load() ([]Term, error) {
+	data, err := os.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %v", err)
+	}
+
+	var saved []savedTerm
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %v", f.path, err)
+	}
+	terms := make([]Term, 0, len(saved))
+	for _, s := range saved {
+		term := s.Term
+		if len(term.DestinationPorts) == 0 && s.DestinationPort != 0 {
+			term.DestinationPorts = []config.PortRange{{From: s.DestinationPort, To: s.DestinationPort}}
+		}
+		if len(term.DestinationPorts) == 0 {
+			log.Printf("dropping term %s from %s, which has no destination ports", term.Comment, f.path)
+			continue
+		}
+		terms = append(terms, term)
+	}
+	return terms, nil
+}
+
+// A term as persisted, including the single DestinationPort written by versions
+// before terms could open several ports
+type savedTerm struct {
+	Term
+	DestinationPort uint16 `json:",omitempty"`
+}
@@ -1,6 +1,18 @@
 package rules
 
-import "net"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/micrictor/jpat/internal/config"
+)
+
+// Prefix of the comment attached to every firewall rule created by jpat
+const COMMENT_PREFIX = "jpat:"
 
 type Socket struct {
 	IP   net.IP
@@ -14,13 +26,73 @@ type Rule struct {
 }
 
 type Term struct {
-	Comment         string
-	SourceAddr      net.IP
+	// Identifies the term to operators. Kept when the term is extended.
+	ID string
+	// sub claim of the token that opened the term, if known
+	Subject    string
+	Comment    string
+	SourceAddr net.IP
+	// If set, the term permits the whole network rather than only SourceAddr
+	SourceNet       *net.IPNet
 	SourcePort      uint16
 	DestinationAddr net.IP
-	DestinationPort uint16
-	Protocol        string
-	Expiration      int64
+	// Opened together, and expired as one
+	DestinationPorts []config.PortRange
+	Protocol         string
+	Expiration       int64
+}
+
+// Source returns the network the term permits traffic from
+func (t Term) Source() *net.IPNet {
+	if t.SourceNet != nil {
+		return t.SourceNet
+	}
+	if ipv4 := t.SourceAddr.To4(); ipv4 != nil {
+		return &net.IPNet{IP: ipv4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: t.SourceAddr, Mask: net.CIDRMask(128, 128)}
+}
+
+// Uniquely identifies the term for backends that track what they have applied
+func (t Term) key() string {
+	return fmt.Sprintf("%s/%v/%v/%s/%d", t.Protocol, t.Source(), t.DestinationAddr, formatPorts(t.DestinationPorts), t.Expiration)
+}
+
+// Join the ranges with commas, such as 21,30000-30100
+func formatPorts(ports []config.PortRange) string {
+	formatted := make([]string, len(ports))
+	for i, port := range ports {
+		formatted[i] = port.String()
+	}
+	return strings.Join(formatted, ",")
+}
+
+// Generate a random term ID
+func newTermID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Build the comment identifying a term in the firewall, which embeds its expiration
+func formatComment(source *net.IPNet, expiration int64) string {
+	return fmt.Sprintf("%s%v;exp=%d", COMMENT_PREFIX, source, expiration)
+}
+
+// Extract the expiration from a comment built by formatComment
+func parseComment(comment string) (int64, bool) {
+	if !strings.HasPrefix(comment, COMMENT_PREFIX) {
+		return 0, false
+	}
+	idx := strings.LastIndex(comment, ";exp=")
+	if idx < 0 {
+		return 0, false
+	}
+	expiration, err := strconv.ParseInt(comment[idx+len(";exp="):], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return expiration, true
 }
 
 type Policy struct {
@@ -0,0 +1,107 @@
+// Package signing signs AuthReply messages, so clients can check that a reply
+// came from the server they sent their token to.
+package signing
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	pb "github.com/micrictor/jpat/pkg/jpat"
+)
+
+// Prefixed to the signed data, so a reply signature can't be reused for anything else
+const REPLY_CONTEXT = "jpat reply v1"
+
+var ErrMissingSignature = errors.New("reply is not signed")
+var ErrInvalidSignature = errors.New("reply signature is invalid")
+
+// Build the data a reply signature covers: the hash of the token the reply
+// answers, followed by every reply field except the signature.
+func replyData(token string, reply *pb.AuthReply) []byte {
+	tokenHash := sha256.Sum256([]byte(token))
+	var data bytes.Buffer
+	data.WriteString(REPLY_CONTEXT)
+	data.Write(tokenHash[:])
+	binary.Write(&data, binary.BigEndian, uint32(reply.Status))
+	writeString(&data, reply.Socket)
+	binary.Write(&data, binary.BigEndian, reply.Expiration)
+	writeString(&data, reply.Message)
+	return data.Bytes()
+}
+
+// Length-prefix strings, so that moving bytes between fields changes the data
+func writeString(data *bytes.Buffer, value string) {
+	binary.Write(data, binary.BigEndian, uint32(len(value)))
+	data.WriteString(value)
+}
+
+// SignReply sets the reply's signature over the token and the reply fields
+func SignReply(key ed25519.PrivateKey, token string, reply *pb.AuthReply) {
+	reply.Signature = ed25519.Sign(key, replyData(token, reply))
+}
+
+// VerifyReply checks that the reply to token was signed by key
+func VerifyReply(key ed25519.PublicKey, token string, reply *pb.AuthReply) error {
+	if len(reply.Signature) == 0 {
+		return ErrMissingSignature
+	}
+	if !ed25519.Verify(key, replyData(token, reply), reply.Signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// LoadPrivateKey reads a PEM-encoded PKCS #8 Ed25519 private key, as written by
+// openssl genpkey -algorithm ed25519
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPem(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 private key", path)
+	}
+	return edKey, nil
+}
+
+// LoadPublicKey reads a PEM-encoded PKIX Ed25519 public key, as written by
+// openssl pkey -pubout
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPem(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 public key", path)
+	}
+	return edKey, nil
+}
+
+func readPem(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	return block.Bytes, nil
+}
@@ -0,0 +1,78 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/micrictor/jpat/pkg/jpat"
+)
+
+const testToken = "header.payload.signature"
+
+func testReply() *pb.AuthReply {
+	return &pb.AuthReply{Socket: "192.0.2.1:22", Expiration: 1700000000}
+}
+
+func TestVerifyReply(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	otherPublic, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	testCases := []struct {
+		name   string
+		key    ed25519.PublicKey
+		token  string
+		tamper func(*pb.AuthReply)
+		err    error
+	}{
+		{"valid", public, testToken, func(*pb.AuthReply) {}, nil},
+		{"socket changed", public, testToken, func(r *pb.AuthReply) { r.Socket = "203.0.113.1:22" }, ErrInvalidSignature},
+		{"expiration changed", public, testToken, func(r *pb.AuthReply) { r.Expiration++ }, ErrInvalidSignature},
+		{"status changed", public, testToken, func(r *pb.AuthReply) { r.Status = pb.Status_DENIED }, ErrInvalidSignature},
+		{"message changed", public, testToken, func(r *pb.AuthReply) { r.Message = "hello" }, ErrInvalidSignature},
+		{"other token", public, testToken + "x", func(*pb.AuthReply) {}, ErrInvalidSignature},
+		{"other key", otherPublic, testToken, func(*pb.AuthReply) {}, ErrInvalidSignature},
+		{"unsigned", public, testToken, func(r *pb.AuthReply) { r.Signature = nil }, ErrMissingSignature},
+	}
+	for _, tc := range testCases {
+		reply := testReply()
+		SignReply(private, testToken, reply)
+		tc.tamper(reply)
+		if err := VerifyReply(tc.key, tc.token, reply); err != tc.err {
+			t.Errorf("%s: VerifyReply returned %v, expected %v", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	privateDer, _ := x509.MarshalPKCS8PrivateKey(private)
+	publicDer, _ := x509.MarshalPKIXPublicKey(public)
+
+	dir := t.TempDir()
+	privateFile, publicFile := filepath.Join(dir, "server.key"), filepath.Join(dir, "server.pub")
+	os.WriteFile(privateFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDer}), 0600)
+	os.WriteFile(publicFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDer}), 0600)
+
+	loadedPrivate, err := LoadPrivateKey(privateFile)
+	if err != nil {
+		t.Fatalf("failed to load private key: %v", err)
+	}
+	loadedPublic, err := LoadPublicKey(publicFile)
+	if err != nil {
+		t.Fatalf("failed to load public key: %v", err)
+	}
+	reply := testReply()
+	SignReply(loadedPrivate, testToken, reply)
+	if err := VerifyReply(loadedPublic, testToken, reply); err != nil {
+		t.Errorf("loaded keys do not verify: %v", err)
+	}
+
+	if _, err := LoadPublicKey(privateFile); err == nil {
+		t.Errorf("expected an error loading a private key as a public key")
+	}
+}
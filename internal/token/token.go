@@ -1,16 +1,132 @@
 package token
 
 import (
+	"encoding/json"
+	"fmt"
+	"time"
+
 	config "github.com/micrictor/jpat/internal/config"
 
 	jwt "github.com/golang-jwt/jwt"
 )
 
+// ClaimError is returned when a registered claim fails validation.
+type ClaimError struct {
+	Claim  string
+	Reason string
+}
+
+func (e *ClaimError) Error() string {
+	return fmt.Sprintf("claim %s is invalid: %s", e.Claim, e.Reason)
+}
+
 func ProcessToken(token string, configuration *config.AppConfig) (*jwt.Token, error) {
-	resultToken, err := jwt.Parse(token, configuration.Keyfunc)
+	// Claims are validated below, so that the configured leeway applies
+	parser := jwt.Parser{SkipClaimsValidation: true}
+	resultToken, err := parser.Parse(token, configuration.Keyfunc)
 	if err != nil {
 		return nil, err
 	}
 
+	claims, ok := resultToken.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, fmt.Errorf("failed to get token claims")
+	}
+	if err := validateClaims(claims, configuration.Verification, time.Now()); err != nil {
+		return nil, err
+	}
+
 	return resultToken, err
 }
+
+// Validate the exp, nbf, iat, iss and aud claims, allowing verification.Leeway of clock skew.
+func validateClaims(claims jwt.MapClaims, verification config.VerificationConfig, now time.Time) error {
+	leeway := time.Duration(verification.Leeway)
+
+	exp, present, err := timeClaim(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if !present {
+		return &ClaimError{Claim: "exp", Reason: "missing"}
+	}
+	if now.After(exp.Add(leeway)) {
+		return &ClaimError{Claim: "exp", Reason: fmt.Sprintf("token expired at %v", exp)}
+	}
+
+	nbf, present, err := timeClaim(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if present && now.Add(leeway).Before(nbf) {
+		return &ClaimError{Claim: "nbf", Reason: fmt.Sprintf("token is not valid before %v", nbf)}
+	}
+
+	iat, present, err := timeClaim(claims, "iat")
+	if err != nil {
+		return err
+	}
+	if present && iat.After(now.Add(leeway)) {
+		return &ClaimError{Claim: "iat", Reason: fmt.Sprintf("token was issued in the future at %v", iat)}
+	}
+
+	if len(verification.Issuers) > 0 {
+		iss, _ := claims["iss"].(string)
+		if !contains(verification.Issuers, iss) {
+			return &ClaimError{Claim: "iss", Reason: fmt.Sprintf("issuer %q is not trusted", iss)}
+		}
+	}
+
+	if verification.Audience != "" && !audienceContains(claims["aud"], verification.Audience) {
+		return &ClaimError{Claim: "aud", Reason: fmt.Sprintf("token is not intended for audience %q", verification.Audience)}
+	}
+
+	return nil
+}
+
+// Read a NumericDate claim. The second return value reports whether it was set.
+func timeClaim(claims jwt.MapClaims, name string) (time.Time, bool, error) {
+	value, present := claims[name]
+	if !present {
+		return time.Time{}, false, nil
+	}
+
+	var seconds float64
+	switch v := value.(type) {
+	case float64:
+		seconds = v
+	case json.Number:
+		parsed, err := v.Float64()
+		if err != nil {
+			return time.Time{}, true, &ClaimError{Claim: name, Reason: "not a number"}
+		}
+		seconds = parsed
+	default:
+		return time.Time{}, true, &ClaimError{Claim: name, Reason: "not a number"}
+	}
+	return time.Unix(int64(seconds), 0), true, nil
+}
+
+// The aud claim may be a single string or a list of strings
+func audienceContains(aud interface{}, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, item := range v {
+			if item == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
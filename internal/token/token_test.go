@@ -0,0 +1,76 @@
+package token
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/micrictor/jpat/internal/config"
+)
+
+func TestValidateClaims(t *testing.T) {
+	now := time.Now()
+	at := func(offset time.Duration) float64 {
+		return float64(now.Add(offset).Unix())
+	}
+	verification := config.VerificationConfig{
+		Issuers:  []string{"https://idp.example.com", "https://other.example.com"},
+		Audience: "jpat.example.com",
+		Leeway:   config.Duration(30 * time.Second),
+	}
+	valid := func(extra jwt.MapClaims) jwt.MapClaims {
+		claims := jwt.MapClaims{
+			"exp": at(time.Minute),
+			"iss": "https://idp.example.com",
+			"aud": "jpat.example.com",
+		}
+		for k, v := range extra {
+			claims[k] = v
+		}
+		return claims
+	}
+
+	testCases := []struct {
+		name         string
+		claims       jwt.MapClaims
+		failedClaim  string
+		verification config.VerificationConfig
+	}{
+		{"valid", valid(nil), "", verification},
+		{"second issuer", valid(jwt.MapClaims{"iss": "https://other.example.com"}), "", verification},
+		{"audience list", valid(jwt.MapClaims{"aud": []interface{}{"other", "jpat.example.com"}}), "", verification},
+		{"expired within leeway", valid(jwt.MapClaims{"exp": at(-10 * time.Second)}), "", verification},
+		{"nbf within leeway", valid(jwt.MapClaims{"nbf": at(10 * time.Second)}), "", verification},
+		{"iat within leeway", valid(jwt.MapClaims{"iat": at(10 * time.Second)}), "", verification},
+		{"missing exp", jwt.MapClaims{"iss": "https://idp.example.com", "aud": "jpat.example.com"}, "exp", verification},
+		{"expired", valid(jwt.MapClaims{"exp": at(-time.Minute)}), "exp", verification},
+		{"not yet valid", valid(jwt.MapClaims{"nbf": at(time.Minute)}), "nbf", verification},
+		{"issued in future", valid(jwt.MapClaims{"iat": at(time.Minute)}), "iat", verification},
+		{"non-numeric iat", valid(jwt.MapClaims{"iat": "yesterday"}), "iat", verification},
+		{"untrusted issuer", valid(jwt.MapClaims{"iss": "https://evil.example.com"}), "iss", verification},
+		{"missing issuer", jwt.MapClaims{"exp": at(time.Minute), "aud": "jpat.example.com"}, "iss", verification},
+		{"wrong audience", valid(jwt.MapClaims{"aud": "other.example.com"}), "aud", verification},
+		{"wrong audience list", valid(jwt.MapClaims{"aud": []interface{}{"other"}}), "aud", verification},
+		{"expired without leeway", valid(jwt.MapClaims{"exp": at(-10 * time.Second)}), "exp", config.VerificationConfig{}},
+		{"unchecked iss and aud", jwt.MapClaims{"exp": at(time.Minute), "iss": "anyone"}, "", config.VerificationConfig{}},
+	}
+	for _, tc := range testCases {
+		err := validateClaims(tc.claims, tc.verification, now)
+		if tc.failedClaim == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tc.name, err)
+			}
+			continue
+		}
+
+		var claimErr *ClaimError
+		if !errors.As(err, &claimErr) {
+			t.Errorf("%s: expected ClaimError, got %v", tc.name, err)
+			continue
+		}
+		if claimErr.Claim != tc.failedClaim {
+			t.Errorf("%s: claim %s does not match expected claim %s", tc.name, claimErr.Claim, tc.failedClaim)
+		}
+	}
+}
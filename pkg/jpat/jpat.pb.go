@@ -24,8 +24,83 @@ var _ = math.Inf
 // proto package needs to be updated.
 const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
+// Outcome of an authorization request
+type Status int32
+
+const (
+	Status_OK Status = 0
+	// The request was rejected, without saying why
+	Status_DENIED            Status = 1
+	Status_INVALID_SIGNATURE Status = 2
+	Status_EXPIRED           Status = 3
+	// A registered claim such as nbf, iss or aud failed validation
+	Status_INVALID_CLAIMS  Status = 4
+	Status_POLICY_DENIED   Status = 5
+	Status_REPLAY          Status = 6
+	Status_RATE_LIMITED    Status = 7
+	Status_UNKNOWN_SERVICE Status = 8
+	// The service can't be reached over the client's IP version
+	Status_UNSUPPORTED_ADDRESS_FAMILY Status = 9
+	Status_INTERNAL_ERROR             Status = 10
+	// A sealed request could not be opened, or the server requires sealed requests
+	Status_INVALID_ENVELOPE Status = 11
+	// The request's timestamp is outside the server's freshness window
+	Status_STALE_REQUEST Status = 12
+)
+
+var Status_name = map[int32]string{
+	0:  "OK",
+	1:  "DENIED",
+	2:  "INVALID_SIGNATURE",
+	3:  "EXPIRED",
+	4:  "INVALID_CLAIMS",
+	5:  "POLICY_DENIED",
+	6:  "REPLAY",
+	7:  "RATE_LIMITED",
+	8:  "UNKNOWN_SERVICE",
+	9:  "UNSUPPORTED_ADDRESS_FAMILY",
+	10: "INTERNAL_ERROR",
+	11: "INVALID_ENVELOPE",
+	12: "STALE_REQUEST",
+}
+
+var Status_value = map[string]int32{
+	"OK":                         0,
+	"DENIED":                     1,
+	"INVALID_SIGNATURE":          2,
+	"EXPIRED":                    3,
+	"INVALID_CLAIMS":             4,
+	"POLICY_DENIED":              5,
+	"REPLAY":                     6,
+	"RATE_LIMITED":               7,
+	"UNKNOWN_SERVICE":            8,
+	"UNSUPPORTED_ADDRESS_FAMILY": 9,
+	"INTERNAL_ERROR":             10,
+	"INVALID_ENVELOPE":           11,
+	"STALE_REQUEST":              12,
+}
+
+func (x Status) String() string {
+	return proto.EnumName(Status_name, int32(x))
+}
+
+func (Status) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_1991f7b5beaea4bd, []int{0}
+}
+
 type AuthRequest struct {
-	Token                string   `protobuf:"bytes,1,opt,name=token,proto3" json:"token,omitempty"`
+	Token string `protobuf:"bytes,1,opt,name=token,proto3" json:"token,omitempty"`
+	// Name of the service to open. Empty selects the server's default service.
+	Service string `protobuf:"bytes,2,opt,name=service,proto3" json:"service,omitempty"`
+	// Set when the request is sealed to the server's envelope key. Sealed requests
+	// carry an AuthRequest encrypted to the server, and leave the fields above empty.
+	EphemeralKey []byte `protobuf:"bytes,3,opt,name=ephemeral_key,json=ephemeralKey,proto3" json:"ephemeral_key,omitempty"`
+	Sealed       []byte `protobuf:"bytes,4,opt,name=sealed,proto3" json:"sealed,omitempty"`
+	// Freshness stamp: the client's clock in unix seconds, a random nonce, and an
+	// HMAC binding them to the token and service
+	Timestamp            int64    `protobuf:"varint,5,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Nonce                []byte   `protobuf:"bytes,6,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	Mac                  []byte   `protobuf:"bytes,7,opt,name=mac,proto3" json:"mac,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -63,9 +138,57 @@ func (m *AuthRequest) GetToken() string {
 	return ""
 }
 
+func (m *AuthRequest) GetService() string {
+	if m != nil {
+		return m.Service
+	}
+	return ""
+}
+
+func (m *AuthRequest) GetEphemeralKey() []byte {
+	if m != nil {
+		return m.EphemeralKey
+	}
+	return nil
+}
+
+func (m *AuthRequest) GetSealed() []byte {
+	if m != nil {
+		return m.Sealed
+	}
+	return nil
+}
+
+func (m *AuthRequest) GetTimestamp() int64 {
+	if m != nil {
+		return m.Timestamp
+	}
+	return 0
+}
+
+func (m *AuthRequest) GetNonce() []byte {
+	if m != nil {
+		return m.Nonce
+	}
+	return nil
+}
+
+func (m *AuthRequest) GetMac() []byte {
+	if m != nil {
+		return m.Mac
+	}
+	return nil
+}
+
 type AuthReply struct {
-	Socket               string   `protobuf:"bytes,1,opt,name=socket,proto3" json:"socket,omitempty"`
-	Expiration           int64    `protobuf:"varint,2,opt,name=expiration,proto3" json:"expiration,omitempty"`
+	Socket     string `protobuf:"bytes,1,opt,name=socket,proto3" json:"socket,omitempty"`
+	Expiration int64  `protobuf:"varint,2,opt,name=expiration,proto3" json:"expiration,omitempty"`
+	Status     Status `protobuf:"varint,3,opt,name=status,proto3,enum=jpat.Status" json:"status,omitempty"`
+	// Why the request was rejected, unless the server hides details
+	Message string `protobuf:"bytes,4,opt,name=message,proto3" json:"message,omitempty"`
+	// Ed25519 signature over the hash of the request's token and the fields above,
+	// if the server has a signing key
+	Signature            []byte   `protobuf:"bytes,5,opt,name=signature,proto3" json:"signature,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -110,7 +233,29 @@ func (m *AuthReply) GetExpiration() int64 {
 	return 0
 }
 
+func (m *AuthReply) GetStatus() Status {
+	if m != nil {
+		return m.Status
+	}
+	return Status_OK
+}
+
+func (m *AuthReply) GetMessage() string {
+	if m != nil {
+		return m.Message
+	}
+	return ""
+}
+
+func (m *AuthReply) GetSignature() []byte {
+	if m != nil {
+		return m.Signature
+	}
+	return nil
+}
+
 func init() {
+	proto.RegisterEnum("jpat.Status", Status_name, Status_value)
 	proto.RegisterType((*AuthRequest)(nil), "jpat.AuthRequest")
 	proto.RegisterType((*AuthReply)(nil), "jpat.AuthReply")
 }
@@ -120,19 +265,40 @@ func init() {
 }
 
 var fileDescriptor_1991f7b5beaea4bd = []byte{
-	// 192 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0x12, 0x2e, 0xc8, 0x4e, 0xd7,
-	0xcf, 0x2a, 0x48, 0x2c, 0x01, 0x13, 0x7a, 0x05, 0x45, 0xf9, 0x25, 0xf9, 0x42, 0x2c, 0x20, 0xb6,
-	0x92, 0x32, 0x17, 0xb7, 0x63, 0x69, 0x49, 0x46, 0x50, 0x6a, 0x61, 0x69, 0x6a, 0x71, 0x89, 0x90,
-	0x08, 0x17, 0x6b, 0x49, 0x7e, 0x76, 0x6a, 0x9e, 0x04, 0xa3, 0x02, 0xa3, 0x06, 0x67, 0x10, 0x84,
-	0xa3, 0xe4, 0xcc, 0xc5, 0x09, 0x51, 0x54, 0x90, 0x53, 0x29, 0x24, 0xc6, 0xc5, 0x56, 0x9c, 0x9f,
-	0x9c, 0x9d, 0x5a, 0x02, 0x55, 0x03, 0xe5, 0x09, 0xc9, 0x71, 0x71, 0xa5, 0x56, 0x14, 0x64, 0x16,
-	0x25, 0x96, 0x64, 0xe6, 0xe7, 0x49, 0x30, 0x29, 0x30, 0x6a, 0x30, 0x07, 0x21, 0x89, 0x18, 0x39,
-	0x71, 0xb1, 0x78, 0x15, 0x24, 0x96, 0x08, 0x59, 0x71, 0x89, 0x40, 0x6d, 0x03, 0x99, 0x99, 0x5f,
-	0x94, 0x59, 0x05, 0x96, 0x17, 0x12, 0xd4, 0x03, 0x3b, 0x0e, 0xc9, 0x35, 0x52, 0xfc, 0xc8, 0x42,
-	0x05, 0x39, 0x95, 0x4e, 0xd2, 0x51, 0x92, 0xe9, 0x99, 0x25, 0x19, 0xa5, 0x49, 0x7a, 0xc9, 0xf9,
-	0xb9, 0xfa, 0xb9, 0x99, 0xc9, 0x45, 0x99, 0xc9, 0x25, 0xf9, 0x45, 0x60, 0x6f, 0x25, 0xb1, 0x81,
-	0xfd, 0x65, 0x0c, 0x08, 0x00, 0x00, 0xff, 0xff, 0xf3, 0x8c, 0xbc, 0x1d, 0xee, 0x00, 0x00, 0x00,
+	// 517 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x4c, 0x92, 0x41, 0x73, 0x93, 0x40,
+	0x14, 0xc7, 0xa5, 0x49, 0x88, 0x79, 0xa1, 0xed, 0x66, 0x1b, 0x1d, 0xac, 0x4e, 0x27, 0x53, 0x3d,
+	0x64, 0x3c, 0xa4, 0x33, 0xf5, 0xe6, 0x8d, 0x86, 0xd5, 0x59, 0x43, 0x00, 0x17, 0x12, 0x8d, 0x17,
+	0x86, 0xe2, 0x4e, 0x82, 0x09, 0x01, 0x61, 0xe3, 0x18, 0xbf, 0x8d, 0xdf, 0xc4, 0x6f, 0xe5, 0xd5,
+	0x61, 0x21, 0x36, 0x17, 0x66, 0xff, 0xbf, 0x85, 0xf7, 0xde, 0xff, 0xf1, 0x87, 0x8b, 0x6c, 0xbd,
+	0xbc, 0xf9, 0x96, 0x85, 0x42, 0x3e, 0x46, 0x59, 0x9e, 0x8a, 0x14, 0x37, 0xcb, 0xf3, 0xf5, 0x1f,
+	0x05, 0xba, 0xc6, 0x4e, 0xac, 0x18, 0xff, 0xbe, 0xe3, 0x85, 0xc0, 0x7d, 0x68, 0x89, 0x74, 0xcd,
+	0xb7, 0xba, 0x32, 0x50, 0x86, 0x1d, 0x56, 0x09, 0xac, 0x43, 0xbb, 0xe0, 0xf9, 0x8f, 0x38, 0xe2,
+	0xfa, 0x89, 0xe4, 0x07, 0x89, 0x5f, 0xc2, 0x29, 0xcf, 0x56, 0x3c, 0xe1, 0x79, 0xb8, 0x09, 0xd6,
+	0x7c, 0xaf, 0x37, 0x06, 0xca, 0x50, 0x63, 0xda, 0x7f, 0x38, 0xe1, 0x7b, 0xfc, 0x14, 0xd4, 0x82,
+	0x87, 0x1b, 0xfe, 0x55, 0x6f, 0xca, 0xdb, 0x5a, 0xe1, 0x17, 0xd0, 0x11, 0x71, 0xc2, 0x0b, 0x11,
+	0x26, 0x99, 0xde, 0x1a, 0x28, 0xc3, 0x06, 0x7b, 0x00, 0xe5, 0x28, 0xdb, 0x74, 0x1b, 0x71, 0x5d,
+	0x95, 0x1f, 0x55, 0x02, 0x23, 0x68, 0x24, 0x61, 0xa4, 0xb7, 0x25, 0x2b, 0x8f, 0xd7, 0xbf, 0x15,
+	0xe8, 0x54, 0x16, 0xb2, 0x4d, 0xd5, 0x2b, 0x8d, 0xd6, 0x5c, 0xd4, 0x0e, 0x6a, 0x85, 0xaf, 0x00,
+	0xf8, 0xcf, 0x2c, 0xce, 0x43, 0x11, 0xa7, 0x5b, 0xe9, 0xa2, 0xc1, 0x8e, 0x08, 0x7e, 0x05, 0x6a,
+	0x21, 0x42, 0xb1, 0x2b, 0xa4, 0x83, 0xb3, 0x5b, 0x6d, 0x24, 0x77, 0xe5, 0x49, 0xc6, 0xea, 0xbb,
+	0x72, 0x11, 0x09, 0x2f, 0x8a, 0x70, 0xc9, 0xa5, 0x95, 0x0e, 0x3b, 0xc8, 0xd2, 0x4b, 0x11, 0x2f,
+	0xb7, 0xa1, 0xd8, 0xe5, 0x5c, 0x7a, 0xd1, 0xd8, 0x03, 0x78, 0xfd, 0x57, 0x01, 0xb5, 0x2a, 0x85,
+	0x55, 0x38, 0x71, 0x26, 0xe8, 0x11, 0x06, 0x50, 0x4d, 0x62, 0x53, 0x62, 0x22, 0x05, 0x3f, 0x81,
+	0x1e, 0xb5, 0xe7, 0x86, 0x45, 0xcd, 0xc0, 0xa3, 0xef, 0x6d, 0xc3, 0x9f, 0x31, 0x82, 0x4e, 0x70,
+	0x17, 0xda, 0xe4, 0xb3, 0x4b, 0x19, 0x31, 0x51, 0x03, 0x63, 0x38, 0x3b, 0xbc, 0x33, 0xb6, 0x0c,
+	0x3a, 0xf5, 0x50, 0x13, 0xf7, 0xe0, 0xd4, 0x75, 0x2c, 0x3a, 0x5e, 0x04, 0x75, 0xa9, 0x56, 0x59,
+	0x96, 0x11, 0xd7, 0x32, 0x16, 0x48, 0xc5, 0x08, 0x34, 0x66, 0xf8, 0x24, 0xb0, 0xe8, 0x94, 0xfa,
+	0xc4, 0x44, 0x6d, 0x7c, 0x01, 0xe7, 0x33, 0x7b, 0x62, 0x3b, 0x9f, 0xec, 0xc0, 0x23, 0x6c, 0x4e,
+	0xc7, 0x04, 0x3d, 0xc6, 0x57, 0x70, 0x39, 0xb3, 0xbd, 0x99, 0xeb, 0x3a, 0xcc, 0x27, 0x66, 0x60,
+	0x98, 0x26, 0x23, 0x9e, 0x17, 0xbc, 0x33, 0xa6, 0xd4, 0x5a, 0xa0, 0x4e, 0xd5, 0xd9, 0x27, 0xcc,
+	0x36, 0xac, 0x80, 0x30, 0xe6, 0x30, 0x04, 0xb8, 0x0f, 0xe8, 0x30, 0x0d, 0xb1, 0xe7, 0xc4, 0x72,
+	0x5c, 0x82, 0xba, 0xe5, 0x3c, 0x9e, 0x6f, 0x58, 0x24, 0x60, 0xe4, 0xe3, 0x8c, 0x78, 0x3e, 0xd2,
+	0x6e, 0xef, 0xa0, 0xf9, 0x21, 0x0b, 0x05, 0x7e, 0x0b, 0xfd, 0x3a, 0x63, 0xe5, 0xbf, 0x4a, 0xf3,
+	0xf8, 0x57, 0xb5, 0xf7, 0x5e, 0xb5, 0xe7, 0xa3, 0x0c, 0x5e, 0x9e, 0x1f, 0xa3, 0x6c, 0xb3, 0xbf,
+	0x7b, 0xfe, 0xe5, 0xd9, 0x32, 0x16, 0xab, 0xdd, 0xfd, 0x28, 0x4a, 0x93, 0x9b, 0x24, 0x8e, 0xf2,
+	0x38, 0x12, 0x69, 0x2e, 0xd3, 0x7c, 0xaf, 0xca, 0x38, 0xbf, 0xf9, 0x37, 0x00, 0x86, 0x10, 0x5f,
+	0xd8, 0xe5, 0x02, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.